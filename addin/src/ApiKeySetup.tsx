@@ -1,4 +1,5 @@
 import React, { useState, useEffect } from 'react';
+import { daemonFetch } from './daemon';
 
 interface ApiKeySetupProps {
   onApiKeySubmit: (apiKey: string) => Promise<void>;
@@ -37,7 +38,7 @@ const ApiKeySetup: React.FC<ApiKeySetupProps> = ({ onApiKeySubmit }) => {
       // Test with backend validation endpoint
       setIsValidating(true);
       try {
-        const response = await fetch('http://localhost:8080/api/key/validate', {
+        const response = await daemonFetch('/api/key/validate', {
           method: 'POST',
           headers: {
             'Content-Type': 'application/json',
@@ -15,9 +15,16 @@ interface ImageAttachment {
   bytes: number;
 }
 
+// The model the user picked over the chat profile's; unset means the profile decides
+const MODEL_OVERRIDE_KEY = 'modelOverride';
+// Where older versions kept the dropdown's value, which always held a model
+const LEGACY_MODEL_KEY = 'selectedModel';
+
 const InputBox: React.FC<InputBoxProps> = ({ onSendMessage, disabled, isStreaming, onStopStreaming, safeRoot, triggerStatusBarError }) => {
   const [message, setMessage] = useState<string>('');
-  const [selectedModel, setSelectedModel] = useState<string>('claude-4-sonnet');
+  // '' leaves the model to the daemon's chat profile; anything else is the user's explicit choice
+  const [selectedModel, setSelectedModel] = useState<string>('');
+  const [thinkingEnabled, setThinkingEnabled] = useState<boolean>(false);
   const [images, setImages] = useState<ImageAttachment[]>([]);
   const [imageError, setImageError] = useState<string | null>(null);
   const [hoveredImageId, setHoveredImageId] = useState<string | null>(null);
@@ -190,7 +197,7 @@ const InputBox: React.FC<InputBoxProps> = ({ onSendMessage, disabled, isStreamin
         }
       }
       
-      onSendMessage(content, selectedModel);
+      onSendMessage(content, selectedModel, thinkingEnabled);
       setMessage('');
       setImages(prev => {
         // Clean up preview URLs
@@ -230,20 +237,35 @@ const InputBox: React.FC<InputBoxProps> = ({ onSendMessage, disabled, isStreamin
 
   const handleModelChange = (value: string): void => {
     setSelectedModel(value);
-    localStorage.setItem('selectedModel', value);
+    if (value) {
+      localStorage.setItem(MODEL_OVERRIDE_KEY, value);
+    } else {
+      localStorage.removeItem(MODEL_OVERRIDE_KEY);
+    }
   };
 
   const modelOptions: DropdownOption[] = [
+    { value: '', label: 'Default model' },
     { value: 'claude-4-sonnet', label: 'Claude 4 Sonnet' },
     { value: 'claude-3.7-sonnet', label: 'Claude 3.7 Sonnet' }
   ];
 
-  // Load saved model preference on component mount
+  const handleThinkingToggle = (): void => {
+    const enabled = !thinkingEnabled;
+    setThinkingEnabled(enabled);
+    localStorage.setItem('thinkingEnabled', String(enabled));
+  };
+
+  // Load saved model and thinking preferences on component mount
   React.useEffect(() => {
-    const savedModel = localStorage.getItem('selectedModel');
+    // Older versions saved the dropdown's default under LEGACY_MODEL_KEY, so it isn't an
+    // explicit choice; drop it and leave the model to the profile
+    localStorage.removeItem(LEGACY_MODEL_KEY);
+    const savedModel = localStorage.getItem(MODEL_OVERRIDE_KEY);
     if (savedModel) {
       setSelectedModel(savedModel);
     }
+    setThinkingEnabled(localStorage.getItem('thinkingEnabled') === 'true');
   }, []);
 
   return (
@@ -325,12 +347,26 @@ const InputBox: React.FC<InputBoxProps> = ({ onSendMessage, disabled, isStreamin
           </div>
 
           <div className="input-footer">
-            <ModelDropdown
-              value={selectedModel}
-              onChange={handleModelChange}
-              disabled={disabled}
-              options={modelOptions}
-            />
+            <div className="input-options">
+              <ModelDropdown
+                value={selectedModel}
+                onChange={handleModelChange}
+                disabled={disabled}
+                options={modelOptions}
+              />
+
+              {/* Extended thinking: the model reasons before answering */}
+              <button
+                type="button"
+                onClick={handleThinkingToggle}
+                disabled={disabled}
+                className={`thinking-option ${thinkingEnabled ? 'active' : ''}`}
+                aria-pressed={thinkingEnabled}
+                title="Let the model think before it answers"
+              >
+                Thinking
+              </button>
+            </div>
 
             <div className="input-actions">
               {/* Hidden file input */}
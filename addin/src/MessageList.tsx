@@ -7,6 +7,7 @@ const MessageList: React.FC<MessageListProps> = ({ messages, isLoading }) => {
   const messagesEndRef = useRef<HTMLDivElement>(null);
   const messageListRef = useRef<HTMLDivElement>(null);
   const [expandedErrors, setExpandedErrors] = useState<Set<string>>(new Set());
+  const [expandedThinking, setExpandedThinking] = useState<Set<string>>(new Set());
 
 
   const scrollToBottom = () => {
@@ -42,7 +43,8 @@ const MessageList: React.FC<MessageListProps> = ({ messages, isLoading }) => {
   };
 
   const buildCopyText = (content: any[]) => {
-    return content.map((item, index) => {
+    // Thinking isn't part of the answer
+    return content.filter(item => item.type !== 'thinking').map((item, index) => {
       if (item.type === 'text') {
         return item.content;
       } else if (item.type === 'tool_call') {
@@ -120,6 +122,42 @@ const MessageList: React.FC<MessageListProps> = ({ messages, isLoading }) => {
     );
   };
 
+  const toggleThinkingExpansion = (thinkingId: string) => {
+    setExpandedThinking(prev => {
+      const newSet = new Set(prev);
+      if (newSet.has(thinkingId)) {
+        newSet.delete(thinkingId);
+      } else {
+        newSet.add(thinkingId);
+      }
+      return newSet;
+    });
+  };
+
+  // Thinking stays open while it streams, then collapses to a toggle
+  const renderThinking = (content: string, thinkingId: string, isThinking: boolean) => {
+    const isExpanded = isThinking || expandedThinking.has(thinkingId);
+
+    return (
+      <div key={thinkingId} className={`thinking-block${isThinking ? ' active' : ''}`}>
+        <button
+          className="thinking-header"
+          onClick={() => toggleThinkingExpansion(thinkingId)}
+          disabled={isThinking}
+          aria-expanded={isExpanded}
+        >
+          <svg className="thinking-chevron" width="10" height="10" viewBox="0 0 12 12" fill="none">
+            <path d="M4.5 3L7.5 6L4.5 9" stroke="currentColor" strokeWidth="1.5" strokeLinecap="round" strokeLinejoin="round"/>
+          </svg>
+          {isThinking ? 'Thinking…' : 'Thought process'}
+        </button>
+        {isExpanded && (
+          <div className="thinking-content">{content}</div>
+        )}
+      </div>
+    );
+  };
+
   return (
     <div 
       className="message-list" 
@@ -149,6 +187,12 @@ const MessageList: React.FC<MessageListProps> = ({ messages, isLoading }) => {
                     ) : item.type === 'image' ? (
                       // Don't render images in user messages
                       null
+                    ) : item.type === 'thinking' ? (
+                      renderThinking(
+                        item.content,
+                        `${message.id}-${index}`,
+                        isLoading && isLastAssistantMessage && index === message.content.length - 1
+                      )
                     ) : item.type === 'text' ? (
                         <ReactMarkdown
                           key={index}
@@ -243,7 +287,8 @@ const MessageList: React.FC<MessageListProps> = ({ messages, isLoading }) => {
                             )}
                           </div>
                         ) : (
-                          <div key={index} className={`tool-call-box ${item.toolCall?.status}`}>
+                          <React.Fragment key={index}>
+                          <div className={`tool-call-box ${item.toolCall?.status}`}>
                             <span className="tool-call-text">{item.content}</span>
                             <div className="tool-call-icon">
                               {item.toolCall?.status === 'requesting' && (
@@ -263,6 +308,10 @@ const MessageList: React.FC<MessageListProps> = ({ messages, isLoading }) => {
                               )}
                             </div>
                           </div>
+                          {item.inputPreview && (
+                            <pre className="tool-call-preview">{item.inputPreview}</pre>
+                          )}
+                          </React.Fragment>
                         )
                       )
                     ))}
@@ -16,13 +16,8 @@ const ModelDropdown: React.FC<ModelDropdownProps> = ({ value, onChange, disabled
   const [isOpen, setIsOpen] = useState(false);
   const dropdownRef = useRef<HTMLDivElement>(null);
 
-  let selectedOption = options.find(option => option.value === value);
-  if (!selectedOption) { // Default to Claude 4 Sonnet if no option is selected
-    selectedOption = {
-      value: "claude-4-sonnet",
-      label: "Claude 4 Sonnet"
-    }
-  }
+  // Fall back to the first option, the default model, for a value that's no longer offered
+  const selectedOption = options.find(option => option.value === value) || options[0];
 
   const handleOptionClick = (optionValue: string) => {
     onChange(optionValue);
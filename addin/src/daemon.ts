@@ -0,0 +1,108 @@
+// The Rishi daemon only listens on loopback and rejects requests without the
+// per-launch auth token. The addin opens the viewer with the daemon's URL and
+// token in the URL fragment, along with the ID of the R session serving the
+// page, so tool calls go back to it. The fragment never reaches the page's
+// server, so other users on the machine can't read the token by fetching
+// index.html.
+
+interface DaemonConnection {
+  url: string;
+  token: string | null;
+  rSessionId: string | null;
+}
+
+const STORAGE_KEY = 'rishi-daemon';
+
+// The default is only used when the page is opened without the addin
+const DEFAULT_DAEMON_URL = 'http://127.0.0.1:8080';
+
+const readConnection = (): DaemonConnection => {
+  const params = new URLSearchParams(window.location.hash.slice(1));
+  if (params.has('token')) {
+    const connection: DaemonConnection = {
+      url: params.get('daemon_url') || DEFAULT_DAEMON_URL,
+      token: params.get('token'),
+      rSessionId: params.get('r_session_id'),
+    };
+    // Keep the connection for reloads and take the token out of the address
+    sessionStorage.setItem(STORAGE_KEY, JSON.stringify(connection));
+    window.history.replaceState(null, '', window.location.pathname + window.location.search);
+    return connection;
+  }
+
+  const stored = sessionStorage.getItem(STORAGE_KEY);
+  if (stored) {
+    try {
+      return JSON.parse(stored) as DaemonConnection;
+    } catch {
+      sessionStorage.removeItem(STORAGE_KEY);
+    }
+  }
+  return { url: DEFAULT_DAEMON_URL, token: null, rSessionId: null };
+};
+
+const connection = readConnection();
+
+// The daemon picks a free port when the addin starts it
+export const DAEMON_URL = connection.url;
+
+// How often the page asks its R session to re-register, so the daemon picks it up again
+// if it restarted or dropped the session as unresponsive
+export const R_SESSION_REGISTER_INTERVAL_MS = 30000;
+
+// reregisterRSession asks the R session serving this page to register with the daemon
+// again, through the local server the page was loaded from
+export const reregisterRSession = async (): Promise<boolean> => {
+  if (!connection.rSessionId) {
+    return false;
+  }
+  try {
+    const response = await fetch('/register', { method: 'POST' });
+    return response.ok;
+  } catch {
+    return false;
+  }
+};
+
+// isUnknownRSession reports whether a response says the daemon doesn't know this page's
+// R session
+const isUnknownRSession = async (response: Response): Promise<boolean> => {
+  if (response.status !== 404 || !connection.rSessionId) {
+    return false;
+  }
+  try {
+    const data = await response.clone().json();
+    return data.error?.details?.r_session_id === connection.rSessionId;
+  } catch {
+    return false;
+  }
+};
+
+// daemonFetch calls a daemon endpoint with the auth token and R session attached. If the
+// daemon has forgotten the R session, the session re-registers and the request is retried.
+// The daemon only allows this page's origin while the session is registered, so a
+// forgotten session can also show up as a failed fetch.
+export const daemonFetch = async (path: string, init: RequestInit = {}): Promise<Response> => {
+  const headers = new Headers(init.headers);
+  if (connection.token) {
+    headers.set('Authorization', `Bearer ${connection.token}`);
+  }
+  if (connection.rSessionId) {
+    headers.set('X-R-Session-ID', connection.rSessionId);
+  }
+  const send = () => fetch(`${DAEMON_URL}${path}`, { ...init, headers });
+
+  let response: Response;
+  try {
+    response = await send();
+  } catch (error) {
+    if (await reregisterRSession()) {
+      return send();
+    }
+    throw error;
+  }
+  if (await isUnknownRSession(response) && await reregisterRSession()) {
+    return send();
+  }
+  return response;
+};
@@ -20,7 +20,10 @@ interface ImageContent {
 interface ToolCallContent {
   type: 'tool_call';
   content: string;
+  // The input streamed so far (code, file text) shown while the model is still writing it
+  inputPreview?: string;
   toolCall?: {
+    id?: string;
     name: string;
     status: ToolCallStatus;
     input?: object;
@@ -34,8 +37,15 @@ interface ErrorContent {
   content: string;
 }
 
+// Extended thinking the model streamed before answering; shown apart from the answer
+// and never sent back as history
+interface ThinkingContent {
+  type: 'thinking';
+  content: string;
+}
+
 // Union of all content types
-export type MessageContent = TextContent | ImageContent | ToolCallContent | ErrorContent;
+export type MessageContent = TextContent | ImageContent | ToolCallContent | ErrorContent | ThinkingContent;
 
 export interface Message {
   id: number;
@@ -45,7 +55,8 @@ export interface Message {
 }
 
 export interface InputBoxProps {
-  onSendMessage: (content: MessageContent[], model: string) => void;
+  // model is '' unless the user picked one, leaving it to the daemon's chat profile
+  onSendMessage: (content: MessageContent[], model: string, thinking: boolean) => void;
   disabled: boolean;
   isStreaming: boolean;
   onStopStreaming: () => void;
@@ -58,14 +69,68 @@ export interface MessageListProps {
   isLoading: boolean;
 }
 
+// Error envelope returned by every daemon endpoint and stream (see daemon/internal/errcode)
+export interface ApiError {
+  code: string;
+  message: string;
+  retryable: boolean;
+  details?: Record<string, unknown>;
+  request_id?: string;
+}
+
+// Stored API key status from GET /api/key; the key itself is never returned
+export interface ApiKeyStatus {
+  has_key: boolean;
+  provider: string;
+  masked_key?: string;
+  last_validated_at: string | null;
+}
+
+export interface UsageTotals {
+  turns: number;
+  input_tokens: number;
+  output_tokens: number;
+  cache_creation_input_tokens: number;
+  cache_read_input_tokens: number;
+  cache_hit_rate: number;
+  cost_usd: number;
+}
+
 export interface ChatResponse {
   text?: string;
+  thinking?: string;
+  tool_input_delta?: {
+    tool_use_id: string;
+    name: string;
+    partial_json: string;
+  };
   tool_call?: {
+    id: string;
     name: string;
     input: object;
     status: ToolCallStatus;
     result?: string;
   };
+  instructions?: {
+    files: Array<{ path: string; scope: 'user' | 'project'; bytes: number }>;
+  };
+  usage?: {
+    model: string;
+    input_tokens: number;
+    output_tokens: number;
+    cache_creation_input_tokens: number;
+    cache_read_input_tokens: number;
+    cost_usd: number;
+    run: UsageTotals;
+    session?: UsageTotals;
+  };
+  retrying?: {
+    attempt: number;
+    max_attempts: number;
+    wait_ms: number;
+    error: ApiError;
+    discard_partial: boolean;
+  };
   is_final?: boolean;
-  error?: string;
+  error?: ApiError;
 }
\ No newline at end of file
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/halliday/rishi/daemon/internal/api"
+	"github.com/halliday/rishi/daemon/internal/credentials"
+)
+
+// keyValidationTimeout bounds the request validating an API key with Anthropic
+const keyValidationTimeout = 30 * time.Second
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// runConfig reads and writes config.json. The daemon picks up changes to its settings
+// without restarting.
+func runConfig(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: rishi-daemon config get [KEY] | config set KEY VALUE")
+	}
+	switch args[0] {
+	case "get":
+		if len(args) > 2 {
+			return errors.New("usage: rishi-daemon config get [KEY]")
+		}
+		key := ""
+		if len(args) == 2 {
+			key = args[1]
+		}
+		value, err := api.GetConfigValue(key)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(value))
+		return nil
+
+	case "set":
+		if len(args) != 3 {
+			return errors.New("usage: rishi-daemon config set KEY VALUE")
+		}
+		// Values that aren't JSON, such as 30m, are taken as strings
+		value := json.RawMessage(args[2])
+		if !json.Valid(value) {
+			value, _ = json.Marshal(args[2])
+		}
+		return api.SetConfigValue(args[1], value)
+	}
+	return fmt.Errorf("unknown config command %q", args[0])
+}
+
+// openCredentialStore opens the credential store the daemon uses
+func openCredentialStore() (credentials.Store, error) {
+	snapshot, err := api.LoadSettings(nil)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewCredentialStore(snapshot.Settings.CredentialsPassphrase)
+}
+
+// runKey stores and validates Anthropic API keys
+func runKey(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: rishi-daemon key set|validate [-name NAME]")
+	}
+	fs := flag.NewFlagSet("key "+args[0], flag.ExitOnError)
+	name := fs.String("name", credentials.DefaultName, "name of the API key")
+	fs.Parse(args[1:])
+
+	ref, err := api.ParseAnthropicRef(*name)
+	if err != nil {
+		return err
+	}
+	store, err := openCredentialStore()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "set":
+		// The key is read from stdin rather than an argument so it stays out of shell history
+		fmt.Fprintln(os.Stderr, "Paste the Anthropic API key and press Enter:")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		apiKey := strings.TrimSpace(line)
+		if apiKey == "" {
+			return errors.New("no API key given")
+		}
+		if err := store.Set(credentials.Credential{Provider: ref.Provider, Name: ref.Name, Secret: apiKey}); err != nil {
+			return fmt.Errorf("failed to save API key: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Saved API key %s\n", ref)
+		return nil
+
+	case "validate":
+		cred, err := store.Get(ref)
+		if err != nil {
+			return fmt.Errorf("no API key %s is stored", ref)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), keyValidationTimeout)
+		defer cancel()
+		if apiErr := api.ValidateAPIKey(ctx, cred.Secret); apiErr != nil {
+			return fmt.Errorf("API key %s is invalid: %s", ref, apiErr.Message)
+		}
+		if cred.Source != "env" {
+			validatedAt := time.Now().UTC()
+			cred.ValidatedAt = &validatedAt
+			if err := store.Set(cred); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to record the validation time:", err)
+			}
+		}
+		fmt.Printf("API key %s is valid\n", ref)
+		return nil
+	}
+	return fmt.Errorf("unknown key command %q", args[0])
+}
+
+// runSessions lists and exports chat sessions from the usage history
+func runSessions(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: rishi-daemon sessions list | sessions export ID")
+	}
+	switch args[0] {
+	case "list":
+		return printJSON(api.ListChatSessions())
+	case "export":
+		if len(args) != 2 {
+			return errors.New("usage: rishi-daemon sessions export ID")
+		}
+		return api.ExportChatSession(args[1], os.Stdout)
+	}
+	return fmt.Errorf("unknown sessions command %q", args[0])
+}
+
+// runUsage prints token usage and cost like GET /usage
+func runUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	from := fs.String("from", "", "start of the period, RFC 3339 or YYYY-MM-DD")
+	to := fs.String("to", "", "end of the period, RFC 3339 or YYYY-MM-DD (inclusive)")
+	groupBy := fs.String("group-by", "day", "model, session or day")
+	fs.Parse(args)
+
+	report, err := api.UsageReport(*from, *to, *groupBy)
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/halliday/rishi/daemon/internal/api"
+)
+
+// doctorTimeout bounds each of doctor's requests to the daemon and the R tool server
+const doctorTimeout = 5 * time.Second
+
+// doctorHealth is the part of the daemon's GET /health report that doctor checks
+type doctorHealth struct {
+	Status      string `json:"status"`
+	Version     string `json:"version"`
+	ToolServers []struct {
+		RSessionID string  `json:"r_session_id"`
+		Address    string  `json:"address"`
+		Reachable  bool    `json:"reachable"`
+		LatencyMS  float64 `json:"latency_ms"`
+		Error      string  `json:"error"`
+	} `json:"tool_servers"`
+}
+
+// doctor prints the result of each check and remembers whether any failed
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) ok(check, format string, args ...any) {
+	fmt.Printf("ok    %-16s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) warn(check, format string, args ...any) {
+	fmt.Printf("warn  %-16s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+func (d *doctor) fail(check, format string, args ...any) {
+	d.failed = true
+	fmt.Printf("FAIL  %-16s %s\n", check, fmt.Sprintf(format, args...))
+}
+
+// runDoctor checks the config, the daemon's port, the API key, the running daemon and the
+// R tool server, and fails if any check does
+func runDoctor(args []string) error {
+	if len(args) > 0 {
+		return errors.New("usage: rishi-daemon doctor")
+	}
+	d := &doctor{}
+
+	if err := api.ValidateConfigFile(); err != nil {
+		d.fail("config file", "%v", err)
+	} else {
+		d.ok("config file", "valid")
+	}
+
+	snapshot, err := api.LoadSettings(nil)
+	if err != nil {
+		d.fail("settings", "%v", err)
+		snapshot = &api.SettingsSnapshot{Settings: api.DefaultSettings()}
+	} else {
+		d.ok("settings", "loaded from %s and the environment", snapshot.Path)
+	}
+	api.SetSettings(snapshot)
+
+	if store, err := api.NewCredentialStore(snapshot.Settings.CredentialsPassphrase); err != nil {
+		d.fail("api key", "can't open the credential store: %v", err)
+	} else if creds, err := store.List("anthropic"); err != nil {
+		d.fail("api key", "can't read the credential store: %v", err)
+	} else if len(creds) == 0 {
+		d.fail("api key", `no Anthropic API key is stored; add one with "rishi-daemon key set"`)
+	} else {
+		names := make([]string, len(creds))
+		for i, cred := range creds {
+			names[i] = cred.Name
+		}
+		d.ok("api key", "%s", strings.Join(names, ", "))
+	}
+
+	health := d.checkDaemon(snapshot.Settings)
+	d.checkToolServers(health)
+
+	if d.failed {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
+
+// checkDaemon checks the daemon in the discovery file, or that the configured port is free
+// if none is running. It returns the daemon's health report if it's running.
+func (d *doctor) checkDaemon(settings api.Settings) *doctorHealth {
+	discovery, err := api.ReadDiscovery()
+	if errors.Is(err, os.ErrNotExist) {
+		d.warn("daemon", "not running")
+		if settings.HTTPPort == "0" {
+			d.ok("port", "the daemon picks a free port")
+			return nil
+		}
+		address := net.JoinHostPort(settings.HTTPHost, settings.HTTPPort)
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			d.fail("port", "%s is in use by another process: %v", address, err)
+			return nil
+		}
+		listener.Close()
+		d.ok("port", "%s is free", address)
+		return nil
+	}
+	if err != nil {
+		d.fail("daemon", "%v", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.URL+"/health?live=1", nil)
+	if err != nil {
+		d.fail("daemon", "invalid discovery file: %v", err)
+		return nil
+	}
+	req.Header.Set("Authorization", "Bearer "+discovery.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		d.fail("daemon", "pid %d should be listening on %s but isn't responding: %v", discovery.PID, discovery.Address, err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var health doctorHealth
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&health) != nil {
+		d.fail("daemon", "pid %d on %s answered its health check with HTTP %d", discovery.PID, discovery.Address, resp.StatusCode)
+		return nil
+	}
+	d.ok("daemon", "version %s, pid %d, listening on %s, %s", health.Version, discovery.PID, discovery.Address, health.Status)
+	return &health
+}
+
+// checkToolServers reports the R tool servers the running daemon reaches, or pings the one
+// from the settings if no daemon is running. The R tool server only runs while the addin is
+// open in RStudio, so it being down is a warning.
+func (d *doctor) checkToolServers(health *doctorHealth) {
+	if health == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		defer cancel()
+		if err := api.PingToolServer(ctx); err != nil {
+			d.warn("r tool server", "not reachable, is the addin open in RStudio? %v", err)
+		} else {
+			d.ok("r tool server", "reachable")
+		}
+		return
+	}
+
+	for _, server := range health.ToolServers {
+		name := server.Address
+		if server.RSessionID != "" {
+			name = fmt.Sprintf("R session %s at %s", server.RSessionID, server.Address)
+		}
+		if server.Reachable {
+			d.ok("r tool server", "%s, %.1fms", name, server.LatencyMS)
+		} else {
+			d.warn("r tool server", "%s is not reachable, is the addin open in RStudio? %s", name, server.Error)
+		}
+	}
+}
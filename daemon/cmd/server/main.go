@@ -2,45 +2,78 @@ package main
 
 import (
 	"fmt"
-	"net/http"
 	"os"
-	"time"
+	"strings"
 
-	"github.com/halliday/rishi/daemon/internal/api"
 	"github.com/joho/godotenv"
-	"github.com/kelseyhightower/envconfig"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-type Config struct {
-	HTTPPort string `envconfig:"HTTP_PORT" default:"8080"`
-}
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const usage = `Usage: rishi-daemon [command] [flags]
+
+Commands:
+  serve                       run the daemon (the default, so flags alone also start it)
+  config get [KEY]            print config.json, or the value at a dotted KEY such as daemon.idle_timeout
+  config set KEY VALUE        set a dotted KEY to VALUE, given as JSON or as a plain string; null removes it
+  key set [-name NAME]        store an Anthropic API key read from standard input
+  key validate [-name NAME]   check a stored Anthropic API key with Anthropic
+  sessions list               list chat sessions from the usage history
+  sessions export ID          print a chat session's usage records as JSON lines
+  usage [-from] [-to] [-group-by]
+                              print token usage and cost
+  doctor                      check the config, ports, API key, daemon and R tool server
+  version                     print the daemon's version
+
+Run "rishi-daemon serve -h" for the daemon's settings flags.
+`
 
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	log.Logger = log.Output(os.Stdout)
 
-	// Load .env file if it exists
-	if err := godotenv.Load(); err != nil {
-		log.Info().Msg("No .env file found, using system environment variables")
+	command, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	var cfg Config
-	if err := envconfig.Process("", &cfg); err != nil {
-		log.Fatal().Err(err).Msg("Failed to process environment configuration")
+	// Commands other than serve only log warnings, to stderr, leaving stdout to their output
+	if command != "serve" {
+		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.WarnLevel)
+		_ = godotenv.Load()
 	}
 
-	// Build and start HTTP API server
-	srv := api.NewServerClient()
-	httpServer := &http.Server{
-		Addr:              fmt.Sprintf(":%s", cfg.HTTPPort),
-		Handler:           srv.Routes(),
-		ReadHeaderTimeout: 5 * time.Second,
+	var err error
+	switch command {
+	case "serve":
+		// Exit only once serve's deferred cleanup has run
+		if err := serve(args); err != nil {
+			log.Error().Err(err).Msg("Daemon stopped")
+			os.Exit(1)
+		}
+		return
+	case "config":
+		err = runConfig(args)
+	case "key":
+		err = runKey(args)
+	case "sessions":
+		err = runSessions(args)
+	case "usage":
+		err = runUsage(args)
+	case "doctor":
+		err = runDoctor(args)
+	case "version":
+		fmt.Println(version)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
 	}
-
-	log.Info().Str("http_port", cfg.HTTPPort).Msg("Starting HTTP server")
-	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatal().Err(err).Msg("HTTP server failed to start")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rishi-daemon:", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/halliday/rishi/daemon/internal/api"
+	"github.com/halliday/rishi/daemon/internal/logging"
+	"github.com/halliday/rishi/daemon/internal/tracing"
+	"github.com/joho/godotenv"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Log file rotation settings
+	logFileName       = "daemon.log"
+	logFileMaxSize    = 10 * 1024 * 1024 // 10MB
+	logFileMaxBackups = 5
+
+	// Trace file rotation settings
+	traceFileName       = "traces.jsonl"
+	traceFileMaxSize    = 20 * 1024 * 1024 // 20MB
+	traceFileMaxBackups = 2
+
+	// serviceName identifies the daemon in exported traces
+	serviceName = "rishi-daemon"
+
+	// settingsPollInterval is how often config.json is checked for changes
+	settingsPollInterval = 2 * time.Second
+
+	// rSessionHealthInterval is how often registered R sessions are health-checked
+	rSessionHealthInterval = 10 * time.Second
+
+	// httpShutdownTimeout bounds closing idle connections once the active runs are done
+	httpShutdownTimeout = 5 * time.Second
+
+	// watchdogInterval is how often the parent process and idle timeout are checked
+	watchdogInterval = 5 * time.Second
+)
+
+// latestSettings is the most recently applied settings snapshot
+var latestSettings atomic.Pointer[api.SettingsSnapshot]
+
+// serve runs the daemon's HTTP server until it's stopped. It returns errors rather than
+// exiting, so that its deferred cleanup removes the auth token, discovery file and instance
+// lock.
+func serve(args []string) error {
+	log.Logger = log.Output(logging.NewRedactingWriter(os.Stdout))
+
+	// Load .env file if it exists
+	if err := godotenv.Load(); err != nil {
+		log.Info().Msg("No .env file found, using system environment variables")
+	}
+
+	// Settings come from config.json, the environment and flags, in increasing precedence
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	settingsFlags := api.RegisterSettingsFlags(fs)
+	parentPID := fs.Int("parent-pid", 0, "exit once the process with this PID exits, e.g. the R session that launched the daemon")
+	fs.Parse(args)
+
+	// Only one daemon may use the config directory at a time
+	instanceLock, err := api.AcquireInstanceLock()
+	if err != nil {
+		return fmt.Errorf("failed to start: %w", err)
+	}
+	defer instanceLock.Release()
+
+	if err := api.MigrateConfig(); err != nil {
+		log.Error().Err(err).Msg("Failed to migrate config file")
+	}
+	snapshot, err := api.LoadSettings(settingsFlags)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	applySettings(snapshot)
+	cfg := snapshot.Settings
+
+	// Also write logs to a rotating file under the config directory
+	if logFile, err := openLogFile(); err != nil {
+		log.Warn().Err(err).Msg("Logging to stdout only")
+	} else {
+		defer logFile.Close()
+		log.Logger = log.Output(logging.NewRedactingWriter(io.MultiWriter(os.Stdout, logFile)))
+	}
+
+	if cfg.Tracing {
+		if tracer, err := newTracer(cfg); err != nil {
+			log.Warn().Err(err).Msg("Tracing disabled")
+		} else {
+			tracing.SetTracer(tracer)
+			defer tracer.Shutdown(context.Background())
+		}
+	}
+
+	// Apply changes to config.json without restarting
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	go api.WatchSettings(watchCtx, settingsFlags, settingsPollInterval, applySettings)
+
+	// Every request must carry this launch's token, which the addin reads from the config directory
+	authToken, err := api.NewAuthToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate auth token: %w", err)
+	}
+	if err := api.WriteAuthToken(authToken); err != nil {
+		return fmt.Errorf("failed to write auth token: %w", err)
+	}
+	defer api.RemoveAuthToken(authToken)
+
+	credentialStore, err := api.NewCredentialStore(cfg.CredentialsPassphrase)
+	if err != nil {
+		return fmt.Errorf("failed to open credential store: %w", err)
+	}
+	if err := api.MigrateLegacyAPIKey(credentialStore); err != nil {
+		log.Error().Err(err).Msg("Failed to migrate API key from config.json")
+	}
+
+	// Build and start HTTP API server
+	srv := api.NewServerClient(api.ServerOptions{
+		AuthToken:      authToken,
+		AllowedOrigins: cfg.AllowedOrigins,
+		Credentials:    credentialStore,
+		Version:        version,
+	})
+	go srv.MonitorRSessions(watchCtx, rSessionHealthInterval)
+	httpServer := &http.Server{
+		Addr:              net.JoinHostPort(cfg.HTTPHost, cfg.HTTPPort),
+		Handler:           srv.Routes(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	if ip := net.ParseIP(cfg.HTTPHost); ip == nil || !ip.IsLoopback() {
+		log.Warn().Str("http_host", cfg.HTTPHost).Msg("Listening on a non-loopback interface, the daemon is reachable from the network")
+	}
+	listener, err := net.Listen("tcp", httpServer.Addr)
+	if err != nil {
+		return fmt.Errorf("HTTP server failed to start: %w", err)
+	}
+
+	// Publish the address actually bound, which differs from the settings for port 0
+	address := listener.Addr().String()
+	discovery := api.Discovery{
+		Address:   address,
+		URL:       "http://" + address,
+		PID:       os.Getpid(),
+		Version:   version,
+		Token:     authToken,
+		StartedAt: time.Now().UTC(),
+	}
+	if err := api.WriteDiscovery(discovery); err != nil {
+		log.Error().Err(err).Msg("Failed to write discovery file")
+	}
+	defer api.RemoveDiscovery(discovery)
+
+	// Exit on our own once the launching process is gone or the daemon has been idle
+	exit := make(chan string, 1)
+	go srv.RunWatchdog(watchCtx, *parentPID, watchdogInterval, func(reason string) { exit <- reason })
+
+	// On SIGINT, SIGTERM or a watchdog exit, stop starting runs and give the active ones until
+	// the shutdown timeout, then stop the HTTP server so that the deferred cleanup runs. A
+	// second signal stops the daemon immediately.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		var reason string
+		select {
+		case sig := <-stop:
+			reason = sig.String()
+		case reason = <-exit:
+		}
+		timeout := time.Duration(latestSettings.Load().Settings.ShutdownTimeout)
+		log.Info().Str("reason", reason).Dur("timeout", timeout).Msg("Shutting down")
+		signal.Stop(stop)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("Stopped with runs still in progress")
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(ctx); err != nil {
+			httpServer.Close()
+		}
+	}()
+
+	log.Info().Str("address", address).Str("version", version).Msg("Starting HTTP server")
+	if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("HTTP server failed: %w", err)
+	}
+	<-shutdownDone
+	log.Info().Msg("Shut down")
+	return nil
+}
+
+// applySettings makes snapshot the daemon's current settings
+func applySettings(snapshot *api.SettingsSnapshot) {
+	latestSettings.Store(snapshot)
+	api.SetSettings(snapshot)
+	logging.SetPolicy(logging.Policy{
+		Redact:       snapshot.Settings.LogRedact,
+		MetadataOnly: snapshot.Settings.LogMetadataOnly,
+	})
+	if !snapshot.Settings.LogRedact {
+		log.Warn().Msg("Log redaction is disabled, logs may contain secrets and user data")
+	}
+}
+
+// openLogFile opens the rotating daemon log in <config dir>/logs
+func openLogFile() (*logging.RotatingFile, error) {
+	configDir, err := api.ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	return logging.NewRotatingFile(filepath.Join(configDir, "logs", logFileName), logFileMaxSize, logFileMaxBackups)
+}
+
+// newTracer creates a tracer exporting to the configured OTLP collector, or to a rotating
+// OTLP/JSON file in <config dir>/logs if none is configured
+func newTracer(cfg api.Settings) (*tracing.Tracer, error) {
+	resource := tracing.Resource{ServiceName: serviceName}
+
+	if cfg.OTLPEndpoint != "" {
+		log.Info().Str("endpoint", cfg.OTLPEndpoint).Msg("Exporting traces to OTLP collector")
+		return tracing.NewTracer(tracing.NewHTTPExporter(cfg.OTLPEndpoint, resource)), nil
+	}
+
+	configDir, err := api.ConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(configDir, "logs", traceFileName)
+	file, err := logging.NewRotatingFile(path, traceFileMaxSize, traceFileMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Str("path", path).Msg("Exporting traces to file")
+	return tracing.NewTracer(tracing.NewFileExporter(file, resource)), nil
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/halliday/rishi/daemon/internal/errcode"
+)
+
+// authTokenFileName is the file in the config directory holding the current daemon's auth token
+const authTokenFileName = "daemon.token"
+
+// NewAuthToken generates a random per-launch token that clients must present on every request
+func NewAuthToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate auth token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// AuthTokenPath returns the path of the file the auth token is shared through
+func AuthTokenPath() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, authTokenFileName), nil
+}
+
+// WriteAuthToken writes the token to the config directory, readable only by the current user,
+// so that the R addin can pass it to the frontend
+func WriteAuthToken(token string) error {
+	path, err := AuthTokenPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	// Write to a temp file and rename so readers never see a partial token
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(token), 0600); err != nil {
+		return fmt.Errorf("failed to write auth token: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write auth token: %w", err)
+	}
+	return nil
+}
+
+// RemoveAuthToken deletes the token file if it still holds token, leaving one written by a
+// newer daemon in place
+func RemoveAuthToken(token string) {
+	path, err := AuthTokenPath()
+	if err != nil {
+		return
+	}
+	if data, err := os.ReadFile(path); err == nil && string(data) == token {
+		os.Remove(path)
+	}
+}
+
+// RequireToken returns a middleware that rejects requests without the auth token, given as
+// "Authorization: Bearer <token>" or in the X-Rishi-Token header. CORS preflight requests
+// carry no credentials and are answered by the CORS middleware before this one runs.
+func RequireToken(token string) func(http.Handler) http.Handler {
+	expected := []byte(token)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			presented := r.Header.Get("X-Rishi-Token")
+			if auth := r.Header.Get("Authorization"); presented == "" && auth != "" {
+				if scheme, value, ok := strings.Cut(auth, " "); ok && strings.EqualFold(scheme, "Bearer") {
+					presented = strings.TrimSpace(value)
+				}
+			}
+
+			if presented == "" || subtle.ConstantTimeCompare([]byte(presented), expected) != 1 {
+				ctxLog(r.Context()).Warn().Str("path", r.URL.Path).Str("remote_addr", r.RemoteAddr).Msg("Rejected request without a valid auth token")
+				writeError(w, r, errcode.New(errcode.Unauthorized, "missing or invalid daemon auth token"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import "github.com/anthropics/anthropic-sdk-go"
+
+// Prompt caching: Anthropic caches the request prefix up to each block marked with
+// cache_control, in the order tools -> system -> messages. The daemon places the four
+// allowed breakpoints on the last tool definition, the static base system prompt, the
+// dynamic session sections of the system prompt, and the final block of the conversation
+// so far, so every iteration of the tool loop reads the previous iteration's prefix from cache.
+
+// cacheToolDefinitions marks the last tool so the whole tool list is cached
+func cacheToolDefinitions(tools []anthropic.ToolUnionParam) {
+	if len(tools) == 0 {
+		return
+	}
+	if cc := tools[len(tools)-1].GetCacheControl(); cc != nil {
+		*cc = anthropic.NewCacheControlEphemeralParam()
+	}
+}
+
+// markHistoryCacheBreakpoint marks the last cacheable block of the conversation so the
+// prefix up to it is cached for the next model call. Content blocks are shared with the
+// conversation history, so the returned func must be called once the request has been
+// sent to remove the marker; otherwise breakpoints would accumulate across iterations.
+func markHistoryCacheBreakpoint(msgs []anthropic.MessageParam) (unmark func()) {
+	if len(msgs) == 0 {
+		return func() {}
+	}
+
+	content := msgs[len(msgs)-1].Content
+	for i := len(content) - 1; i >= 0; i-- {
+		cc := content[i].GetCacheControl()
+		if cc == nil {
+			continue
+		}
+		if cc.Type != "" {
+			// Already marked by the caller
+			return func() {}
+		}
+		*cc = anthropic.NewCacheControlEphemeralParam()
+		return func() { *cc = anthropic.CacheControlEphemeralParam{} }
+	}
+
+	return func() {}
+}
+
+// cacheHitRate returns the fraction of prompt tokens that were read from cache
+func cacheHitRate(input, cacheCreation, cacheRead int64) float64 {
+	total := input + cacheCreation + cacheRead
+	if total == 0 {
+		return 0
+	}
+	return float64(cacheRead) / float64(total)
+}
@@ -2,17 +2,43 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
-
-	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
 )
 
 // Config represents the Rishi configuration structure
 type Config struct {
-	AnthropicAPIKey string `json:"anthropic_api_key,omitempty"`
+	// Profiles are named chat settings selectable per chat request
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+	// DefaultProfile names the profile used by chats that don't select one
+	DefaultProfile string `json:"default_profile,omitempty"`
+
+	// AnthropicAPIKey and AnthropicAPIKeyValidatedAt are where older versions kept the API
+	// key in plaintext. They're only read to migrate the key into the credential store.
+	AnthropicAPIKey            string     `json:"anthropic_api_key,omitempty"`
+	AnthropicAPIKeyValidatedAt *time.Time `json:"anthropic_api_key_validated_at,omitempty"`
+}
+
+// Profile is a named set of chat settings, e.g. a personal key, a team key with spending
+// caps or a local model behind an Anthropic-compatible endpoint. Empty fields fall back to
+// the chat request or the daemon's defaults.
+type Profile struct {
+	// Provider is the model provider; only "anthropic" is supported
+	Provider string `json:"provider"`
+	// Credential names the stored credential to use, as "provider/name" or just "name"
+	Credential  string   `json:"credential,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+	// BaseURL overrides the provider's API endpoint
+	BaseURL string `json:"base_url,omitempty"`
 }
 
 // getConfigDir returns the platform-appropriate config directory path for Rishi
@@ -45,6 +71,11 @@ func getConfigDir() (string, error) {
 	return configDir, nil
 }
 
+// ConfigDir returns the platform-appropriate config directory path for Rishi
+func ConfigDir() (string, error) {
+	return getConfigDir()
+}
+
 // getConfigPath returns the full path to the config.json file
 func getConfigPath() (string, error) {
 	configDir, err := getConfigDir()
@@ -54,101 +85,127 @@ func getConfigPath() (string, error) {
 	return filepath.Join(configDir, "config.json"), nil
 }
 
-// LoadConfig reads the config file and returns a Config struct
+// LoadConfig reads the config file and returns a Config struct. A corrupt file is backed up
+// and treated as empty.
 func LoadConfig() (*Config, error) {
 	configPath, err := getConfigPath()
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return &Config{}, nil
+	fields, _, err := readConfigFields(configPath)
+	if errors.Is(err, errCorruptConfig) {
+		err = withConfigLock(configPath, func() error {
+			fields, _, err = readConfigFields(configPath)
+			if errors.Is(err, errCorruptConfig) {
+				fields, err = nil, backupCorruptConfig(configPath, err)
+			}
+			return err
+		})
 	}
-
-	data, err := os.ReadFile(configPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
-	}
-
-	var config Config
-	if err := json.Unmarshal(data, &config); err != nil {
-		return nil, fmt.Errorf("failed to parse config file: %w", err)
+		return nil, err
 	}
-
-	return &config, nil
+	return decodeConfig(fields)
 }
 
-// SaveConfig writes the config to the config file
+// SaveConfig writes the config to the config file, keeping fields written by others (such
+// as the R addin's last working directory) that Config doesn't know about
 func SaveConfig(config *Config) error {
-	configDir, err := getConfigDir()
-	if err != nil {
-		return err
-	}
-
-	// Create config directory if it doesn't exist
-	if err := os.MkdirAll(configDir, 0700); err != nil {
-		return fmt.Errorf("failed to create config directory: %w", err)
-	}
+	return updateConfig(func(current *Config) error {
+		*current = *config
+		return nil
+	})
+}
 
+// updateConfig loads the config, applies update and saves the result unless update fails.
+// The config file stays locked throughout, so concurrent updates from this or other
+// processes aren't lost.
+func updateConfig(update func(config *Config) error) error {
 	configPath, err := getConfigPath()
 	if err != nil {
 		return err
 	}
 
-	// Marshal config to JSON with indentation
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal config: %w", err)
-	}
+	return withConfigLock(configPath, func() error {
+		fields, version, err := readConfigFields(configPath)
+		if errors.Is(err, errCorruptConfig) {
+			fields, err = nil, backupCorruptConfig(configPath, err)
+		}
+		if err != nil {
+			return err
+		}
+		if version > currentConfigVersion {
+			return fmt.Errorf("config file has version %d, written by a newer version of Rishi; not modifying it", version)
+		}
 
-	// Write to temp file first for atomic write
-	tempFile, err := os.CreateTemp(configDir, "config.json.*.tmp")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	tempPath := tempFile.Name()
-	defer os.Remove(tempPath) // Clean up if we fail
+		config, err := decodeConfig(fields)
+		if err != nil {
+			return err
+		}
+		if err := update(config); err != nil {
+			return err
+		}
 
-	if _, err := tempFile.Write(data); err != nil {
-		tempFile.Close()
-		return fmt.Errorf("failed to write config: %w", err)
-	}
+		// Fields Config declares are always taken from config, so clearing one removes it
+		// from the file; any other field is carried over unchanged
+		if fields == nil {
+			fields = map[string]json.RawMessage{}
+		}
+		for _, name := range configFieldNames() {
+			delete(fields, name)
+		}
+		data, err := json.Marshal(config)
+		if err != nil {
+			return fmt.Errorf("failed to marshal config: %w", err)
+		}
+		var known map[string]json.RawMessage
+		if err := json.Unmarshal(data, &known); err != nil {
+			return fmt.Errorf("failed to marshal config: %w", err)
+		}
+		maps.Copy(fields, known)
 
-	if err := tempFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temp file: %w", err)
-	}
+		return writeConfigFields(configPath, fields)
+	})
+}
 
-	// Set restrictive permissions (Unix only, no-op on Windows)
-	if err := os.Chmod(tempPath, 0600); err != nil {
-		log.Warn().Err(err).Msg("Failed to set config file permissions")
+// decodeConfig decodes Config from the config file's fields
+func decodeConfig(fields map[string]json.RawMessage) (*Config, error) {
+	var config Config
+	if fields == nil {
+		return &config, nil
 	}
-
-	// Move temp file to final location (atomic on most systems)
-	if err := os.Rename(tempPath, configPath); err != nil {
-		return fmt.Errorf("failed to move config file: %w", err)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	return &config, nil
 }
 
-// GetAPIKey retrieves the ANTHROPIC_API_KEY from the config file
-func GetAPIKey() (string, error) {
-	config, err := LoadConfig()
-	if err != nil {
-		return "", err
+// configFieldNames returns the JSON names of Config's fields
+func configFieldNames() []string {
+	t := reflect.TypeOf(Config{})
+	names := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
 	}
-	return config.AnthropicAPIKey, nil
+	return names
 }
 
-// SetAPIKey saves the ANTHROPIC_API_KEY to the config file
-func SetAPIKey(apiKey string) error {
-	config, err := LoadConfig()
-	if err != nil {
-		// If we can't load config, start with empty config
-		config = &Config{}
+// maskAPIKey returns the key's non-secret prefix and last four characters, e.g. "sk-ant-...wxyz"
+func maskAPIKey(apiKey string) string {
+	if len(apiKey) < 12 {
+		return "..."
 	}
-
-	config.AnthropicAPIKey = apiKey
-	return SaveConfig(config)
+	prefix := ""
+	if strings.HasPrefix(apiKey, "sk-ant-") {
+		prefix = "sk-ant-"
+	}
+	return prefix + "..." + apiKey[len(apiKey)-4:]
 }
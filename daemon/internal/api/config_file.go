@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// configVersionField holds the config file's format version. Files without it are
+	// version 0.
+	configVersionField = "config_version"
+
+	// configLockTimeout bounds how long to wait for another process to release the config
+	// file lock, and configLockStaleAfter is when a lock is considered abandoned by a
+	// process that crashed while holding it
+	configLockTimeout    = 5 * time.Second
+	configLockStaleAfter = 10 * time.Second
+	configLockRetry      = 20 * time.Millisecond
+)
+
+// configMigrations upgrade the config file's fields from one version to the next:
+// configMigrations[n] turns version n into version n+1. The current version is the number
+// of migrations.
+var configMigrations = []func(fields map[string]json.RawMessage) error{
+	// 0 -> 1: version 1 adds the version field itself; fields are otherwise unchanged
+	func(map[string]json.RawMessage) error { return nil },
+}
+
+// currentConfigVersion is the config file version this daemon writes
+var currentConfigVersion = len(configMigrations)
+
+// errCorruptConfig is returned when the config file isn't a JSON object
+var errCorruptConfig = errors.New("config file is corrupt")
+
+// readConfigFields reads the config file's top-level fields, migrated to the current
+// version, along with the version the file was written as. A missing file has no fields;
+// a file from a newer version is returned as is.
+func readConfigFields(path string) (map[string]json.RawMessage, int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, currentConfigVersion, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errCorruptConfig, err)
+	}
+	if fields == nil {
+		return nil, 0, fmt.Errorf("%w: not a JSON object", errCorruptConfig)
+	}
+
+	version := 0
+	if raw, ok := fields[configVersionField]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil || version < 0 {
+			return nil, 0, fmt.Errorf("%w: invalid %s %s", errCorruptConfig, configVersionField, raw)
+		}
+	}
+	for v := version; v < currentConfigVersion; v++ {
+		if err := configMigrations[v](fields); err != nil {
+			return nil, version, fmt.Errorf("failed to migrate config file from version %d: %w", v, err)
+		}
+	}
+	return fields, version, nil
+}
+
+// writeConfigFields atomically replaces the config file with fields, stamped with the
+// current version
+func writeConfigFields(path string, fields map[string]json.RawMessage) error {
+	fields[configVersionField] = json.RawMessage(fmt.Sprint(currentConfigVersion))
+	data, err := json.MarshalIndent(fields, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	// Write to temp file first for atomic write
+	tempFile, err := os.CreateTemp(dir, "config.json.*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath) // Clean up if we fail
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+
+	// Set restrictive permissions (Unix only, no-op on Windows)
+	if err := os.Chmod(tempPath, 0600); err != nil {
+		log.Warn().Err(err).Msg("Failed to set config file permissions")
+	}
+
+	// Move temp file to final location (atomic on most systems)
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to move config file: %w", err)
+	}
+	return nil
+}
+
+// backupCorruptConfig moves a corrupt config file aside so that a fresh one can be written,
+// keeping its content for the user to recover
+func backupCorruptConfig(path string, cause error) error {
+	backupPath := fmt.Sprintf("%s.corrupt-%s", path, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.Rename(path, backupPath); err != nil {
+		return fmt.Errorf("failed to back up corrupt config file: %w", err)
+	}
+	log.Warn().Err(cause).Str("backup", backupPath).Msg("Config file was corrupt, moved it aside and started a new one")
+	return nil
+}
+
+// MigrateConfig upgrades the config file to the current version, backing it up first if
+// it's corrupt
+func MigrateConfig() error {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+
+	return withConfigLock(configPath, func() error {
+		fields, version, err := readConfigFields(configPath)
+		if errors.Is(err, errCorruptConfig) {
+			return backupCorruptConfig(configPath, err)
+		}
+		if err != nil || fields == nil || version >= currentConfigVersion {
+			return err
+		}
+		log.Info().Int("from", version).Int("to", currentConfigVersion).Msg("Migrating config file")
+		return writeConfigFields(configPath, fields)
+	})
+}
+
+// configMus holds a mutex per locked file, serializing its updates within the daemon; the
+// lock directory serializes them with other processes
+var configMus sync.Map
+
+// withConfigLock runs fn while holding the lock of the config file at path, e.g. config.json
+// or credentials.enc. The lock is a directory next to the file, since creating a directory
+// is atomic on every platform and easy to do from R as well. A lock older than
+// configLockStaleAfter is assumed to be abandoned. Locks of different files may be nested,
+// always config.json's first.
+func withConfigLock(path string, fn func() error) error {
+	mu, _ := configMus.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(configLockTimeout)
+	for {
+		err := os.Mkdir(lockPath, 0700)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to lock config file: %w", err)
+		}
+		if info, statErr := os.Stat(lockPath); statErr == nil && time.Since(info.ModTime()) > configLockStaleAfter {
+			log.Warn().Str("lock", lockPath).Msg("Removing stale config file lock")
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for config file lock %s", lockPath)
+		}
+		time.Sleep(configLockRetry)
+	}
+	defer os.Remove(lockPath)
+
+	return fn()
+}
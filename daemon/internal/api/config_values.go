@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GetConfigValue returns the config file's value at key, a dot-separated path such as
+// "daemon.idle_timeout" or "profiles.work.model", or the whole file if key is empty. A
+// legacy plaintext API key is masked.
+func GetConfigValue(key string) (json.RawMessage, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	fields, _, err := readConfigFields(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if raw, ok := fields["anthropic_api_key"]; ok {
+		var apiKey string
+		if json.Unmarshal(raw, &apiKey) == nil {
+			fields["anthropic_api_key"], _ = json.Marshal(maskAPIKey(apiKey))
+		}
+	}
+
+	doc, err := decodeConfigDocument(fields)
+	if err != nil {
+		return nil, err
+	}
+	var value any = doc
+	if key != "" {
+		for _, part := range strings.Split(key, ".") {
+			obj, ok := value.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s is not set", key)
+			}
+			if value, ok = obj[part]; !ok {
+				return nil, fmt.Errorf("%s is not set", key)
+			}
+		}
+	}
+	return json.MarshalIndent(value, "", "  ")
+}
+
+// SetConfigValue sets the config file's value at key, a dot-separated path, creating the
+// objects along it as needed. A null value removes the key. The file is only written if
+// the result is a valid config.
+func SetConfigValue(key string, value json.RawMessage) error {
+	parts := strings.Split(key, ".")
+	if key == "" || parts[0] == configVersionField {
+		return fmt.Errorf("can't set %q", key)
+	}
+	var decoded any
+	if err := unmarshalUseNumber(value, &decoded); err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	return withConfigLock(configPath, func() error {
+		fields, version, err := readConfigFields(configPath)
+		if err != nil {
+			return err
+		}
+		if version > currentConfigVersion {
+			return fmt.Errorf("config file has version %d, written by a newer version of Rishi; not modifying it", version)
+		}
+
+		doc, err := decodeConfigDocument(fields)
+		if err != nil {
+			return err
+		}
+		if err := setConfigPath(doc, parts, decoded); err != nil {
+			return fmt.Errorf("can't set %s: %w", key, err)
+		}
+
+		fields = map[string]json.RawMessage{}
+		for name, v := range doc {
+			if fields[name], err = json.Marshal(v); err != nil {
+				return fmt.Errorf("failed to marshal config: %w", err)
+			}
+		}
+		if err := validateConfigFields(fields); err != nil {
+			return err
+		}
+		return writeConfigFields(configPath, fields)
+	})
+}
+
+// setConfigPath sets the value at path in doc, removing it if value is nil
+func setConfigPath(doc map[string]any, path []string, value any) error {
+	for i, part := range path[:len(path)-1] {
+		next, ok := doc[part]
+		if !ok {
+			if value == nil {
+				return nil
+			}
+			next = map[string]any{}
+			doc[part] = next
+		}
+		obj, ok := next.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s is not an object", strings.Join(path[:i+1], "."))
+		}
+		doc = obj
+	}
+
+	last := path[len(path)-1]
+	if value == nil {
+		delete(doc, last)
+	} else {
+		doc[last] = value
+	}
+	return nil
+}
+
+// decodeConfigDocument decodes the config file's fields into generic JSON values, keeping
+// numbers exact
+func decodeConfigDocument(fields map[string]json.RawMessage) (map[string]any, error) {
+	doc := map[string]any{}
+	for name, raw := range fields {
+		var v any
+		if err := unmarshalUseNumber(raw, &v); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errCorruptConfig, name, err)
+		}
+		doc[name] = v
+	}
+	return doc, nil
+}
+
+func unmarshalUseNumber(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// validateConfigFields checks that the config file's profiles and daemon settings are valid
+func validateConfigFields(fields map[string]json.RawMessage) error {
+	config, err := decodeConfig(fields)
+	if err != nil {
+		return err
+	}
+	for name, profile := range config.Profiles {
+		if !profileNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid profile name %q", name)
+		}
+		if err := validateProfile(&profile); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	if config.DefaultProfile != "" {
+		if _, ok := config.Profiles[config.DefaultProfile]; !ok {
+			return fmt.Errorf("the default profile %s doesn't exist", config.DefaultProfile)
+		}
+	}
+
+	if raw := fields[settingsConfigKey]; raw != nil {
+		fileSettings := DefaultSettings()
+		if _, err := decodeFileSettings(raw, &fileSettings); err != nil {
+			return fmt.Errorf("invalid %q settings: %w", settingsConfigKey, err)
+		}
+		if err := fileSettings.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateConfigFile returns why the config file can't be used, or nil if it can
+func ValidateConfigFile() error {
+	if health := checkConfigFile(); !health.Valid {
+		return errors.New(health.Error)
+	}
+	return nil
+}
@@ -1,9 +1,10 @@
 package api
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/rs/zerolog/log"
+	"github.com/halliday/rishi/daemon/internal/errcode"
 )
 
 type consoleExecInput struct {
@@ -11,18 +12,20 @@ type consoleExecInput struct {
 }
 
 type consoleExecOutput struct {
-	Content string `json:"content"`
-	Error   string `json:"error"`
+	Content   string       `json:"content"`
+	Error     string       `json:"error"`
+	ErrorCode errcode.Code `json:"error_code,omitempty"`
 }
 
-func consoleExec(input consoleExecInput) consoleExecOutput {
+func consoleExec(ctx context.Context, input consoleExecInput) consoleExecOutput {
 	var output consoleExecOutput
 
-	err := makeToolRequest("/console/exec", input, &output)
+	err := makeToolRequest(ctx, "/console/exec", input, &output)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to call console exec endpoint")
+		ctxLog(ctx).Error().Err(err).Str("endpoint", "/console/exec").Msg("Failed to call R tool server")
 		return consoleExecOutput{
-			Error: fmt.Sprintf("Failed to communicate with R server: %v", err),
+			Error:     fmt.Sprintf("Failed to communicate with R server: %v", err),
+			ErrorCode: errcode.ToolServerUnavailable,
 		}
 	}
 
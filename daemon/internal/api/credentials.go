@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/halliday/rishi/daemon/internal/credentials"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// anthropicProvider is the credential provider for Anthropic API keys
+	anthropicProvider = "anthropic"
+
+	// Encrypted credential store files in the config directory
+	credentialsFileName    = "credentials.enc"
+	credentialsKeyFileName = "credentials.key"
+)
+
+// defaultCredentialRef is the credential chats use unless they ask for another
+var defaultCredentialRef = credentials.Ref{Provider: anthropicProvider, Name: credentials.DefaultName}
+
+// NewCredentialStore returns the daemon's credential store: environment variables, which
+// take precedence, layered over the encrypted file in the config directory. The file's key
+// is derived from passphrase if it's set, and otherwise kept in a key file next to it.
+func NewCredentialStore(passphrase string) (credentials.Store, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	credentialsPath := filepath.Join(configDir, credentialsFileName)
+	return credentials.Chain{
+		credentials.NewEnvStore(),
+		credentials.NewFileStore(
+			credentialsPath,
+			filepath.Join(configDir, credentialsKeyFileName),
+			passphrase,
+			// The key subcommands change the file from their own processes
+			func(fn func() error) error { return withConfigLock(credentialsPath, fn) },
+		),
+	}, nil
+}
+
+// MigrateLegacyAPIKey moves a plaintext API key from config.json into the credential store
+// as the default Anthropic credential, then removes it from config.json. A key already in
+// the store is never overwritten. config.json stays locked throughout, so a concurrent
+// migration or config update can't bring the key back or lose other changes.
+func MigrateLegacyAPIKey(store credentials.Store) error {
+	// Only lock and rewrite config.json if there's something to migrate
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	if config.AnthropicAPIKey == "" {
+		return nil
+	}
+
+	return updateConfig(func(config *Config) error {
+		if config.AnthropicAPIKey == "" {
+			return nil
+		}
+
+		existing, err := store.Get(defaultCredentialRef)
+		switch {
+		case errors.Is(err, credentials.ErrNotFound) || (err == nil && existing.Source == "env"):
+			if err := store.Set(credentials.Credential{
+				Provider:    anthropicProvider,
+				Name:        credentials.DefaultName,
+				Secret:      config.AnthropicAPIKey,
+				ValidatedAt: config.AnthropicAPIKeyValidatedAt,
+			}); err != nil {
+				return fmt.Errorf("failed to store API key: %w", err)
+			}
+			log.Info().Msg("Moved API key from config.json to the encrypted credential store")
+		case err != nil:
+			return err
+		default:
+			log.Info().Msg("Credential store already has an API key, discarding the one in config.json")
+		}
+
+		config.AnthropicAPIKey = ""
+		config.AnthropicAPIKeyValidatedAt = nil
+		return nil
+	})
+}
+
+// ParseAnthropicRef parses an Anthropic credential name given as "name" or "anthropic/name"
+func ParseAnthropicRef(name string) (credentials.Ref, error) {
+	if !strings.Contains(name, "/") {
+		name = anthropicProvider + "/" + name
+	}
+	ref, err := credentials.ParseRef(name)
+	if err != nil {
+		return ref, err
+	}
+	if ref.Provider != anthropicProvider {
+		return ref, fmt.Errorf("credential %s is not an Anthropic API key", ref)
+	}
+	return ref, nil
+}
+
+// resolveAPIKey returns the secret of the named Anthropic credential, given as "name" or
+// "anthropic/name", or of the default credential if name is empty
+func (s *ServerClient) resolveAPIKey(ctx context.Context, name string) (string, *errcode.Error) {
+	ref := defaultCredentialRef
+	if name != "" {
+		parsed, err := ParseAnthropicRef(name)
+		if err != nil {
+			return "", errcode.New(errcode.InvalidRequest, err.Error())
+		}
+		ref = parsed
+	}
+
+	cred, err := s.opts.Credentials.Get(ref)
+	switch {
+	case errors.Is(err, credentials.ErrNotFound):
+		return "", errcode.New(errcode.MissingAPIKey, "no API key is stored as "+ref.String()+" and no X-Anthropic-API-Key header was given")
+	case err != nil:
+		ctxLog(ctx).Error().Err(err).Str("credential", ref.String()).Msg("Failed to load stored API key")
+		return "", errcode.New(errcode.ConfigError, "failed to read the credential store")
+	}
+	return cred.Secret, nil
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// discoveryFileName is the file in the config directory describing the running daemon
+const discoveryFileName = "daemon.json"
+
+// Discovery tells launchers where the running daemon listens and how to authenticate with
+// it. It's written once the daemon is listening, so that it holds the actual port when
+// the daemon was asked for port 0, and removed when the daemon exits.
+type Discovery struct {
+	// Address is the "host:port" the daemon listens on, and URL is its base URL
+	Address   string    `json:"address"`
+	URL       string    `json:"url"`
+	PID       int       `json:"pid"`
+	Version   string    `json:"version"`
+	Token     string    `json:"token"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// DiscoveryPath returns the path of the discovery file
+func DiscoveryPath() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, discoveryFileName), nil
+}
+
+// WriteDiscovery writes the discovery file, readable only by the current user since it
+// holds the auth token
+func WriteDiscovery(d Discovery) error {
+	path, err := DiscoveryPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal discovery file: %w", err)
+	}
+
+	// Write to a temp file and rename so readers never see a partial file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write discovery file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write discovery file: %w", err)
+	}
+	return nil
+}
+
+// ReadDiscovery reads the discovery file. It returns an error wrapping os.ErrNotExist if no
+// daemon has written one.
+func ReadDiscovery() (*Discovery, error) {
+	path, err := DiscoveryPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var d Discovery
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("invalid discovery file %s: %w", path, err)
+	}
+	return &d, nil
+}
+
+// RemoveDiscovery deletes the discovery file if it still describes d, leaving one written
+// by a newer daemon in place
+func RemoveDiscovery(d Discovery) {
+	path, err := DiscoveryPath()
+	if err != nil {
+		return
+	}
+	if current, err := ReadDiscovery(); err == nil && current.PID == d.PID && current.Token == d.Token {
+		os.Remove(path)
+	}
+}
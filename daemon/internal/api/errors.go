@@ -1,15 +1,176 @@
 package api
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+)
+
+const (
+	// maxModelRetries is how many times a transient model error is retried within a run
+	maxModelRetries = 4
+
+	// retryBaseDelay and retryMaxDelay bound the exponential backoff between retries
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 30 * time.Second
+
+	// maxRetryWait is the longest server-requested wait a run sits through. Errors asking
+	// for longer are returned instead, with the requested wait in their details.
+	maxRetryWait = 2 * retryMaxDelay
 )
 
+// providerError is a classified error from the model provider
+type providerError struct {
+	Code       errcode.Code
+	Retryable  bool
+	RetryAfter time.Duration // server-requested wait, zero if none
+	Err        error
+}
+
+func (e *providerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *providerError) Unwrap() error {
+	return e.Err
+}
+
+// apiError converts the provider error into the daemon's error envelope
+func (e *providerError) apiError() *errcode.Error {
+	apiErr := errcode.New(e.Code, parseAnthropicError(e.Err))
+	apiErr.Retryable = e.Retryable
+	if e.RetryAfter > 0 {
+		apiErr.WithDetail("retry_after_ms", e.RetryAfter.Milliseconds())
+	}
+	return apiErr
+}
+
+// classifyProviderError determines what kind of failure err is and whether it's worth retrying
+func classifyProviderError(err error) *providerError {
+	var perr *providerError
+	if errors.As(err, &perr) {
+		return perr
+	}
+	perr = &providerError{Code: errcode.ProviderError, Err: err}
+
+	var apiErr *anthropic.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		perr.Code = errcode.Canceled
+	case errors.As(err, &apiErr):
+		switch status := apiErr.StatusCode; {
+		case status == 529:
+			perr.Code, perr.Retryable = errcode.ProviderOverloaded, true
+		case status == http.StatusTooManyRequests:
+			perr.Code, perr.Retryable = errcode.ProviderRateLimited, true
+			if apiErr.Response != nil {
+				perr.RetryAfter = parseRetryAfter(apiErr.Response.Header.Get("Retry-After"))
+			}
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			perr.Code = errcode.ProviderAuthentication
+		case status == http.StatusRequestTimeout || status == http.StatusConflict:
+			perr.Code, perr.Retryable = errcode.ProviderServerError, true
+		case status >= 500:
+			perr.Code, perr.Retryable = errcode.ProviderServerError, true
+		case status >= 400:
+			perr.Code = errcode.ProviderInvalidRequest
+		}
+	case isNetworkError(err):
+		perr.Code, perr.Retryable = errcode.ProviderNetworkError, true
+	default:
+		// Errors sent as SSE events mid-stream only carry the error type in their text
+		msg := err.Error()
+		switch {
+		case strings.Contains(msg, "overloaded_error"):
+			perr.Code, perr.Retryable = errcode.ProviderOverloaded, true
+		case strings.Contains(msg, "rate_limit_error"):
+			perr.Code, perr.Retryable = errcode.ProviderRateLimited, true
+		case strings.Contains(msg, "api_error"):
+			perr.Code, perr.Retryable = errcode.ProviderServerError, true
+		case strings.Contains(msg, "authentication_error") || strings.Contains(msg, "permission_error"):
+			perr.Code = errcode.ProviderAuthentication
+		case strings.Contains(msg, "invalid_request_error"):
+			perr.Code = errcode.ProviderInvalidRequest
+		}
+	}
+
+	return perr
+}
+
+// isNetworkError reports whether err is a connection-level failure such as a reset or timeout
+func isNetworkError(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// retryBackoff returns how long to wait before retry number attempt (starting at 0), using
+// exponential backoff with jitter, never shorter than the server-requested retryAfter and
+// never longer than maxRetryWait.
+func retryBackoff(attempt int, retryAfter time.Duration) time.Duration {
+	ceiling := min(retryBaseDelay<<attempt, retryMaxDelay)
+	delay := retryBaseDelay/2 + rand.N(ceiling-retryBaseDelay/2+1)
+	return min(max(delay, retryAfter), maxRetryWait)
+}
+
 // parseAnthropicError converts Anthropic API errors into user-friendly messages
 func parseAnthropicError(err error) string {
-	errorMsg := err.Error()
-	if strings.Contains(errorMsg, "overloaded_error") || strings.Contains(errorMsg, "Overloaded") {
+	switch classifyProviderError(err).Code {
+	case errcode.ProviderOverloaded:
 		return "Claude is currently experiencing high demand. Please try again in a few moments."
+	case errcode.ProviderRateLimited:
+		return "Your API key has hit Anthropic's rate limit. Please wait a moment and try again."
+	case errcode.ProviderServerError:
+		return "Claude is temporarily unavailable. Please try again in a few moments."
+	case errcode.ProviderNetworkError:
+		return "Could not reach Anthropic. Please check your internet connection and try again."
+	case errcode.ProviderAuthentication:
+		return "Your Anthropic API key was rejected. Please check that it is valid and has access to this model."
+	case errcode.Canceled:
+		return "The request was canceled."
 	}
-	return fmt.Sprintf("Claude encountered an error: %v", err)
+	return "Claude encountered an error: " + err.Error()
+}
+
+// writeError writes an error envelope as the JSON body of an HTTP response
+func writeError(w http.ResponseWriter, r *http.Request, apiErr *errcode.Error) {
+	apiErr.RequestID = requestIDFromContext(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Code.HTTPStatus())
+	json.NewEncoder(w).Encode(errcode.Envelope{Error: apiErr})
+}
+
+// streamError writes an error envelope as a line of an NDJSON stream
+func streamError(w http.ResponseWriter, flusher http.Flusher, r *http.Request, apiErr *errcode.Error) {
+	apiErr.RequestID = requestIDFromContext(r.Context())
+	_ = json.NewEncoder(w).Encode(errcode.Envelope{Error: apiErr})
+	flusher.Flush()
 }
@@ -1,18 +1,22 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
-	"github.com/rs/zerolog/log"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/halliday/rishi/daemon/internal/tracing"
 )
 
-const (
-	defaultMaxTokens = 8192
-)
+// minThinkingBudget is the smallest extended thinking budget the API accepts
+const minThinkingBudget = 1024
 
 // handleChat proxies a streaming request with history to Anthropic and emits NDJSON lines
 // of the form {"text": "..."} and a final {"is_final": true}.
@@ -22,21 +26,13 @@ func (s *ServerClient) handleChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method != http.MethodPost {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Get API key from header
-	apiKey := r.Header.Get("X-Anthropic-API-Key")
-	if apiKey == "" {
-		http.Error(w, "missing X-Anthropic-API-Key header", http.StatusUnauthorized)
+		writeError(w, r, errcode.New(errcode.MethodNotAllowed, "method not allowed"))
 		return
 	}
 
-	// Create Anthropic client for this request
-	anthropicClient := anthropic.NewClient(
-		option.WithAPIKey(apiKey),
-	)
+	// outcome is reported to the chat request counter once the request ends
+	outcome := chatOutcomeCompleted
+	defer func() { chatRequestsTotal.Inc(outcome) }()
 
 	type inboundMessage struct {
 		Role    string           `json:"role"`
@@ -44,29 +40,124 @@ func (s *ServerClient) handleChat(w http.ResponseWriter, r *http.Request) {
 	}
 
 	type reqBody struct {
-		History []inboundMessage `json:"history"`
-		Content []inboundContent `json:"content"` // Changed from Message string
-		Model   string           `json:"model"`
-		MaxTok  int              `json:"max_tokens"`
+		History    []inboundMessage `json:"history"`
+		Content    []inboundContent `json:"content"` // Changed from Message string
+		Model      string           `json:"model"`
+		MaxTok     int              `json:"max_tokens"`
+		SessionID  string           `json:"session_id"`
+		SafeRoot   string           `json:"safe_root"`
+		Credential string           `json:"credential"` // stored API key name, e.g. "work" or "anthropic/work"
+		Profile    string           `json:"profile"`    // named profile, or the default profile if empty
+		RSessionID string           `json:"r_session_id"`
+		Thinking   *struct {
+			Enabled      bool `json:"enabled"`
+			BudgetTokens int  `json:"budget_tokens"`
+		} `json:"thinking"`
 	}
 
 	var in reqBody
 	_ = json.NewDecoder(r.Body).Decode(&in) // tolerate empty/malformed JSON
 
+	// Settings are read once so a reload can't change them halfway through the run
+	settings := currentSettings()
+
+	// Settings the request leaves out come from its profile
+	profileName, profile, apiErr := resolveProfile(in.Profile)
+	if apiErr != nil {
+		outcome = string(apiErr.Code)
+		writeError(w, r, apiErr)
+		return
+	}
+	credentialName := in.Credential
+	if credentialName == "" {
+		credentialName = profile.Credential
+	}
+
+	// Use the API key from the header if given, otherwise the stored credential
+	apiKey := r.Header.Get("X-Anthropic-API-Key")
+	if apiKey == "" {
+		storedKey, apiErr := s.resolveAPIKey(r.Context(), credentialName)
+		if apiErr != nil {
+			outcome = string(apiErr.Code)
+			writeError(w, r, apiErr)
+			return
+		}
+		apiKey = storedKey
+	}
+
+	// Create Anthropic client for this request. Retries are handled by runModelTurn
+	// so that they can be reported to the frontend.
+	clientOpts := []option.RequestOption{
+		option.WithAPIKey(apiKey),
+		option.WithMaxRetries(0),
+	}
+	if profile.BaseURL != "" {
+		clientOpts = append(clientOpts, option.WithBaseURL(profile.BaseURL))
+	}
+	anthropicClient := anthropic.NewClient(clientOpts...)
+
+	// Session ID groups usage across chat requests; run ID identifies this request
+	sessionID := in.SessionID
+	if sessionID == "" {
+		sessionID = r.Header.Get("X-Session-ID")
+	}
+
+	// Tool calls go to the R session this chat session is bound to
+	rSessionID := in.RSessionID
+	if rSessionID == "" {
+		rSessionID = r.Header.Get("X-R-Session-ID")
+	}
+	server, apiErr := s.rSessions.Resolve(sessionID, rSessionID)
+	if apiErr != nil {
+		outcome = string(apiErr.Code)
+		writeError(w, r, apiErr)
+		return
+	}
+
+	runID := newID()
+	ctx := withRun(r.Context(), runID, sessionID)
+	ctx = withToolServer(ctx, server)
+	ctx, runSpan := tracing.Start(ctx, "chat.run", tracing.SpanKindServer,
+		tracing.String("rishi.run_id", runID),
+		tracing.String("rishi.session_id", sessionID),
+		tracing.String("rishi.profile", profileName),
+	)
+	defer func() {
+		runSpan.SetAttributes(tracing.String("rishi.outcome", outcome))
+		if outcome != chatOutcomeCompleted {
+			runSpan.SetStatus(tracing.StatusError, outcome)
+		}
+		runSpan.End()
+	}()
+
+	// A shutdown interrupts the run's model turns once its deadline passes, but lets a tool
+	// call in progress finish so that an edit isn't cut off halfway
+	turnCtx, endRun, ok := s.runs.start(ctx, runID)
+	if !ok {
+		outcome = string(errcode.ShuttingDown)
+		writeError(w, r, errcode.New(errcode.ShuttingDown, "Rishi is shutting down, please try again once it has restarted"))
+		return
+	}
+	defer endRun()
+
+	logger := ctxLog(ctx)
+	w.Header().Set("X-Rishi-Run-ID", runID)
+	activeRuns.Inc()
+	defer activeRuns.Dec()
+
 	w.Header().Set("Content-Type", "application/x-ndjson")
 	w.Header().Set("Cache-Control", "no-cache, no-transform")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		outcome = string(errcode.StreamingUnsupported)
+		writeError(w, r, errcode.New(errcode.StreamingUnsupported, "streaming unsupported"))
 		return
 	}
 
-	// Convert history into []anthropic.MessageParam, include system prompt, then append latest user message
+	// Convert history into []anthropic.MessageParam, then append latest user message
 	var msgs []anthropic.MessageParam
-	// Prepend system prompt as a message to keep behavior similar
-	msgs = append(msgs, anthropic.NewUserMessage(anthropic.NewTextBlock(RISHI_SYSTEM_PROMPT)))
 
 	for i, m := range in.History {
 		switch m.Role {
@@ -74,8 +165,9 @@ func (s *ServerClient) handleChat(w http.ResponseWriter, r *http.Request) {
 			// Convert content blocks for user messages
 			contentBlocks, err := convertToAnthropicContent(m.Content)
 			if err != nil {
-				log.Error().Err(err).Msgf("Error converting user history content")
-				http.Error(w, fmt.Sprintf("Invalid user message content: %v", err), http.StatusBadRequest)
+				logger.Error().Err(err).Int("history_index", i).Msg("Error converting user history content")
+				outcome = string(errcode.InvalidRequest)
+				writeError(w, r, errcode.New(errcode.InvalidRequest, fmt.Sprintf("Invalid user message content: %v", err)))
 				return
 			}
 			if len(contentBlocks) > 0 {
@@ -96,22 +188,23 @@ func (s *ServerClient) handleChat(w http.ResponseWriter, r *http.Request) {
 		default:
 			// ignore
 		}
-		log.Info().Msgf("history message %d: role %s, %d content blocks", i, m.Role, len(m.Content))
+		logger.Debug().Int("history_index", i).Str("role", m.Role).Int("content_blocks", len(m.Content)).Msg("history message")
 	}
 
 	// Handle the new user message content
 	if len(in.Content) > 0 {
 		contentBlocks, err := convertToAnthropicContent(in.Content)
 		if err != nil {
-			log.Error().Err(err).Msgf("Error converting user message content")
-			http.Error(w, fmt.Sprintf("Invalid message content: %v", err), http.StatusBadRequest)
+			logger.Error().Err(err).Msg("Error converting user message content")
+			outcome = string(errcode.InvalidRequest)
+			writeError(w, r, errcode.New(errcode.InvalidRequest, fmt.Sprintf("Invalid message content: %v", err)))
 			return
 		}
 		if len(contentBlocks) > 0 {
 			msgs = append(msgs, anthropic.NewUserMessage(contentBlocks...))
 		}
 	}
-	log.Info().Msgf("new user message: %d content blocks", len(in.Content))
+	logger.Info().Int("history_messages", len(in.History)).Int("content_blocks", len(in.Content)).Msg("new user message")
 
 	// Start streaming with the official Anthropic SDK
 	model := anthropic.ModelClaudeSonnet4_20250514
@@ -122,33 +215,69 @@ func (s *ServerClient) handleChat(w http.ResponseWriter, r *http.Request) {
 		selectedModel = r.Header.Get("X-Model")
 	}
 
-	if selectedModel != "" {
+	// The text editor tool version depends on the model, so it's only offered once the
+	// model is known to support it
+	var textEditorTool *anthropic.ToolUnionParam
+	switch {
+	case selectedModel != "":
 		// Map model names from frontend to Anthropic SDK models
 		switch selectedModel {
 		case "claude-3.7-sonnet":
 			model = anthropic.ModelClaude3_7SonnetLatest
-			log.Info().Msgf("Using Claude 3.7 Sonnet model")
+			textEditorTool = &anthropic.ToolUnionParam{OfTextEditor20250124: &anthropic.ToolTextEditor20250124Param{}}
 		case "claude-4-sonnet":
 			model = anthropic.ModelClaudeSonnet4_20250514
-			log.Info().Msgf("Using Claude 4 Sonnet model")
+			textEditorTool = &anthropic.ToolUnionParam{OfTextEditor20250728: &anthropic.ToolTextEditor20250728Param{}}
 		default:
 			// If unknown model, log and use default
-			log.Warn().Msgf("Unknown model requested: %s, using default Claude 4 Sonnet", selectedModel)
+			logger.Warn().Str("requested_model", selectedModel).Msg("Unknown model requested, using default Claude 4 Sonnet")
 		}
-	} else {
-		log.Info().Msgf("No model specified, using default Claude 4 Sonnet")
+	case profile.Model != "":
+		// Profiles name the provider's model ID directly, e.g. for a local model
+		model = anthropic.Model(profile.Model)
+		textEditorTool = textEditorToolFor(model)
+	default:
+		logger.Info().Msg("No model specified, using default Claude 4 Sonnet")
 	}
 
 	maxTokens := in.MaxTok
 	if maxTokens == 0 {
-		maxTokens = defaultMaxTokens
+		maxTokens = profile.MaxTokens
 	}
+	if maxTokens == 0 {
+		maxTokens = settings.DefaultMaxTokens
+	}
+	logger.Info().Str("model", string(model)).Int("max_tokens", maxTokens).Str("profile", profileName).Str("trace_id", runSpan.TraceID()).Msg("starting run")
+
+	// Extended thinking is opt-in per request. The thinking budget counts towards max_tokens,
+	// and the API rejects a custom temperature while thinking is enabled.
+	var thinking anthropic.ThinkingConfigParamUnion
+	temperature := anthropic.Opt(settings.Temperature)
+	if profile.Temperature != nil {
+		temperature = anthropic.Opt(*profile.Temperature)
+	}
+	if in.Thinking != nil && in.Thinking.Enabled {
+		budget := in.Thinking.BudgetTokens
+		if budget == 0 {
+			budget = settings.ThinkingBudget
+		}
+		budget = max(budget, minThinkingBudget)
+		if budget >= maxTokens {
+			maxTokens = budget + settings.DefaultMaxTokens
+		}
+		thinking = anthropic.ThinkingConfigParamOfEnabled(int64(budget))
+		temperature = param.Opt[float64]{}
+		logger.Info().Int("budget_tokens", budget).Msg("Extended thinking enabled")
+	}
+	runSpan.SetAttributes(
+		tracing.String("gen_ai.request.model", string(model)),
+		tracing.Int("gen_ai.request.max_tokens", maxTokens),
+		tracing.Bool("rishi.thinking", in.Thinking != nil && in.Thinking.Enabled),
+	)
 
 	tools := []anthropic.ToolUnionParam{}
-	if selectedModel == "claude-4-sonnet" {
-		tools = append(tools, anthropic.ToolUnionParam{OfTextEditor20250728: &anthropic.ToolTextEditor20250728Param{}})
-	} else if selectedModel == "claude-3.7-sonnet" {
-		tools = append(tools, anthropic.ToolUnionParam{OfTextEditor20250124: &anthropic.ToolTextEditor20250124Param{}})
+	if textEditorTool != nil {
+		tools = append(tools, *textEditorTool)
 	}
 
 	// Add custom console tools
@@ -159,189 +288,113 @@ func (s *ServerClient) handleChat(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tools = append(tools, anthropic.ToolUnionParam{OfTool: &consoleExecTool})
+	cacheToolDefinitions(tools)
+
+	// The system prompt is built once per request so it stays stable (and cached) across the tool loop
+	system, instructions := s.buildSystemPrompt(ctx, in.SafeRoot)
+	if len(instructions) > 0 {
+		streamInstructions(w, flusher, instructions)
+	}
+
+	var runUsage usageTotals
+	recordPartialTurn := func(partial anthropic.Message) {
+		turnModel := string(partial.Model)
+		if turnModel == "" {
+			turnModel = string(model)
+		}
+		turnUsage := newUsageRecord(sessionID, runID, turnModel, partial.Usage)
+		turnUsage.Partial = true
+		s.usage.Record(turnUsage)
+		recordTokenUsage(turnUsage)
+		runUsage.add(turnUsage)
+	}
 
 	for {
-		stream := anthropicClient.Messages.NewStreaming(r.Context(), anthropic.MessageNewParams{
+		unmarkCache := markHistoryCacheBreakpoint(msgs)
+		message, err := runModelTurn(turnCtx, &anthropicClient, anthropic.MessageNewParams{
 			Model:       model,
 			MaxTokens:   int64(maxTokens),
+			System:      system,
 			Messages:    msgs,
 			Tools:       tools,
-			Temperature: anthropic.Opt(0.1),
-		})
-
-		message := anthropic.Message{}
-		for stream.Next() {
-			event := stream.Current()
-			if err := message.Accumulate(event); err != nil {
-				log.Error().Err(err).Msg("message accumulation error")
-				_ = json.NewEncoder(w).Encode(map[string]any{"error": parseAnthropicError(err)})
-				flusher.Flush()
-				break
-			}
+			Temperature: temperature,
+			Thinking:    thinking,
+		}, w, flusher, recordPartialTurn)
+		unmarkCache()
 
-			switch eventVariant := event.AsAny().(type) {
-			case anthropic.ContentBlockDeltaEvent:
-				switch deltaVariant := eventVariant.Delta.AsAny().(type) {
-				case anthropic.TextDelta:
-					_ = json.NewEncoder(w).Encode(map[string]any{"text": deltaVariant.Text})
-					flusher.Flush()
-				}
+		if err != nil {
+			if errors.Is(context.Cause(turnCtx), errShuttingDown) {
+				logger.Warn().Msg("Run interrupted by shutdown")
+				outcome = string(errcode.ShuttingDown)
+				streamError(w, flusher, r, errcode.New(errcode.ShuttingDown, "Rishi shut down before this response finished, please try again once it has restarted"))
+				return
 			}
+			perr := classifyProviderError(err)
+			logger.Error().Err(err).Str("error_code", string(perr.Code)).Msg("model turn failed")
+			outcome = string(perr.Code)
+			streamError(w, flusher, r, perr.apiError())
+			return
 		}
 
-		// Check for streaming errors
-		if err := stream.Err(); err != nil {
-			log.Error().Err(err).Msg("streaming error occurred")
-			_ = json.NewEncoder(w).Encode(map[string]any{"error": parseAnthropicError(err)})
-			flusher.Flush()
-			return
+		// Record and report token usage for this model turn
+		turnUsage := newUsageRecord(sessionID, runID, string(message.Model), message.Usage)
+		s.usage.Record(turnUsage)
+		recordTokenUsage(turnUsage)
+		runUsage.add(turnUsage)
+		runSpan.SetAttributes(
+			tracing.Int("rishi.turns", runUsage.Turns),
+			tracing.Int64("gen_ai.usage.input_tokens", runUsage.InputTokens),
+			tracing.Int64("gen_ai.usage.output_tokens", runUsage.OutputTokens),
+			tracing.Float64("rishi.cost_usd", runUsage.CostUSD),
+		)
+		var sessionUsage *usageTotals
+		if sessionID != "" {
+			totals := s.usage.SessionTotals(sessionID)
+			sessionUsage = &totals
 		}
+		streamUsage(w, flusher, turnUsage, runUsage, sessionUsage)
+
+		// Keep the assistant turn intact: thinking blocks must be passed back unmodified,
+		// with their signatures, alongside the tool_use blocks that follow them.
+		msgs = append(msgs, message.ToParam())
 
 		toolResults := []anthropic.ContentBlockParamUnion{}
 		for _, block := range message.Content {
-			switch variant := block.AsAny().(type) {
-			case anthropic.TextBlock:
-				msgs = append(msgs, anthropic.NewAssistantMessage(anthropic.NewTextBlock(variant.Text)))
-			case anthropic.ToolUseBlock:
-				log.Info().Msgf("tool use: %s, input: %s", block.Name, variant.JSON.Input.Raw())
-
-				var response interface{}
-				switch block.Name {
-				case "console_exec":
-					var input consoleExecInput
-					if err := json.Unmarshal([]byte(variant.JSON.Input.Raw()), &input); err != nil {
-						errMsg := fmt.Sprintf("Failed to parse console exec input: %s, error: %v", variant.JSON.Input.Raw(), err)
-						log.Error().Err(err).Msgf(errMsg)
-						response = consoleExecOutput{
-							Error: errMsg,
-						}
-						break
-					}
-
-					streamToolCallStart(w, flusher, "console_exec", input)
-					response = consoleExec(input)
-
-				case "str_replace_based_edit_tool":
-					var input textEditorInput
-					if err := json.Unmarshal([]byte(variant.JSON.Input.Raw()), &input); err != nil {
-						errMsg := fmt.Sprintf("Failed to parse text editor input: %s, error: %v", variant.JSON.Input.Raw(), err)
-						log.Error().Err(err).Msgf(errMsg)
-						response = textEditorViewOutput{
-							Error: errMsg,
-						}
-						break
-					}
-
-					// Validate required fields
-					if input.Command == "" {
-						errMsg := "Error: Missing required 'command' field. The text editor tool requires a 'command' parameter. Available commands: 'view' (to read files/directories). Example: {\"command\": \"view\", \"path\": \"filename.txt\"}"
-						log.Error().Msg(errMsg)
-						response = textEditorViewOutput{
-							Error: errMsg,
-						}
-						break
-					}
-
-					switch input.Command {
-					case ViewCommand:
-						viewInput := textEditorViewInput{
-							Path:      input.Path,
-							ViewRange: input.ViewRange,
-						}
-						streamToolCallStart(w, flusher, string(input.Command), viewInput)
-						response = textEditorView(viewInput)
-					case StrReplaceCommand:
-						strReplaceInput := textEditorStrReplaceInput{
-							Path:   input.Path,
-							OldStr: input.OldStr,
-							NewStr: input.NewStr,
-						}
-						streamToolCallStart(w, flusher, string(input.Command), strReplaceInput)
-						response = textEditorStrReplace(strReplaceInput)
-					case CreateCommand:
-						createInput := textEditorCreateInput{
-							Path:     input.Path,
-							FileText: input.FileText,
-						}
-						streamToolCallStart(w, flusher, string(input.Command), createInput)
-						response = textEditorCreate(createInput)
-					case InsertCommand:
-						// Handle both field names - docs say new_str but API sends insert_text
-						insertText := input.NewStr
-						if insertText == "" {
-							insertText = input.InsertText
-						}
-						insertInput := textEditorInsertInput{
-							Path:       input.Path,
-							InsertLine: input.InsertLine,
-							NewStr:     insertText,
-						}
-						streamToolCallStart(w, flusher, string(input.Command), insertInput)
-						response = textEditorInsert(insertInput)
-					}
-				}
-
-				b, err := json.Marshal(response)
-				if err != nil {
-					http.Error(w, "error parsing tool result", http.StatusInternalServerError)
-					return
-				}
-
-				log.Info().Msgf("tool call completed: %s, result length: %d, result: %s", block.Name, len(string(b)), string(b)[:min(100, len(string(b)))])
-
-				var isError bool
-
-				// Stream tool call completion event to frontend
-				switch block.Name {
-				case "console_exec":
-					var input consoleExecInput
-					if err := json.Unmarshal([]byte(variant.JSON.Input.Raw()), &input); err != nil {
-						log.Error().Err(err).Msgf("Failed to parse console exec input for completion event")
-					}
-
-					isError = streamToolCallComplete(w, flusher, "console_exec", input, response)
-				case "str_replace_based_edit_tool":
-					var input textEditorInput
-					if err := json.Unmarshal([]byte(variant.JSON.Input.Raw()), &input); err != nil {
-						errMsg := fmt.Sprintf("Failed to parse text editor input: %s, error: %v", variant.JSON.Input.Raw(), err)
-						log.Error().Err(err).Msgf(errMsg)
-					}
-
-					var commandName string
-					switch response.(type) {
-					case textEditorViewOutput:
-						commandName = string(ViewCommand)
-					case textEditorStrReplaceOutput:
-						commandName = string(StrReplaceCommand)
-					case textEditorCreateOutput:
-						commandName = string(CreateCommand)
-					case textEditorInsertOutput:
-						commandName = string(InsertCommand)
-					}
-
-					isError = streamToolCallComplete(w, flusher, commandName, input, response)
-				}
-
-				msgs = append(msgs, anthropic.NewAssistantMessage(anthropic.NewToolUseBlock(block.ID, json.RawMessage(variant.JSON.Input.Raw()), block.Name)))
+			toolUse, ok := block.AsAny().(anthropic.ToolUseBlock)
+			if !ok {
+				continue
+			}
 
-				toolResults = append(toolResults, anthropic.NewToolResultBlock(block.ID, string(b), isError))
-				msgs = append(msgs, anthropic.NewUserMessage(toolResults...))
+			result, isError, err := executeToolUse(ctx, w, flusher, toolUse)
+			if err != nil {
+				outcome = string(errcode.Internal)
+				streamError(w, flusher, r, errcode.New(errcode.Internal, err.Error()))
+				return
 			}
+			toolResults = append(toolResults, anthropic.NewToolResultBlock(toolUse.ID, result, isError))
 		}
 
 		if len(toolResults) == 0 {
 			// If no tool results, we're done streaming
-			if stream.Err() != nil {
-				_ = json.NewEncoder(w).Encode(map[string]any{"error": stream.Err().Error()})
-				flusher.Flush()
-				return
-			}
-
 			_ = json.NewEncoder(w).Encode(map[string]any{"is_final": true})
 			flusher.Flush()
 
 			break
 		}
+
+		msgs = append(msgs, anthropic.NewUserMessage(toolResults...))
 	}
 
 }
+
+// textEditorToolFor returns the text editor tool version supported by an Anthropic model
+// ID, or nil for models that aren't known to support it
+func textEditorToolFor(model anthropic.Model) *anthropic.ToolUnionParam {
+	switch id := string(model); {
+	case strings.HasPrefix(id, "claude-3-7-sonnet"):
+		return &anthropic.ToolUnionParam{OfTextEditor20250124: &anthropic.ToolTextEditor20250124Param{}}
+	case strings.HasPrefix(id, "claude-sonnet-4"), strings.HasPrefix(id, "claude-opus-4"):
+		return &anthropic.ToolUnionParam{OfTextEditor20250728: &anthropic.ToolTextEditor20250728Param{}}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/halliday/rishi/daemon/internal/errcode"
+)
+
+// buildInfo describes the daemon binary
+type buildInfo struct {
+	GoVersion    string `json:"go_version"`
+	Revision     string `json:"revision,omitempty"`
+	RevisionTime string `json:"revision_time,omitempty"`
+	Modified     bool   `json:"modified,omitempty"`
+}
+
+// readBuildInfo returns the Go version and VCS details embedded in the binary
+func readBuildInfo() buildInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return buildInfo{}
+	}
+	build := buildInfo{GoVersion: info.GoVersion}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.time":
+			build.RevisionTime = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	return build
+}
+
+// toolServerHealth is the result of checking one R tool server
+type toolServerHealth struct {
+	RSessionID string  `json:"r_session_id,omitempty"`
+	Address    string  `json:"address"`
+	Reachable  bool    `json:"reachable"`
+	LatencyMS  float64 `json:"latency_ms"`
+	Error      string  `json:"error,omitempty"`
+	// Busy is set while the session runs a tool call, which health checks skip
+	Busy      bool      `json:"busy,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// credentialHealth reports which credentials a provider has, without their secrets
+type credentialHealth struct {
+	Present bool     `json:"present"`
+	Names   []string `json:"names"`
+}
+
+// configHealth reports whether the config file can be read and applied
+type configHealth struct {
+	Path    string `json:"path"`
+	Valid   bool   `json:"valid"`
+	Version int    `json:"version"`
+	Error   string `json:"error,omitempty"`
+}
+
+// healthReport is the body of GET /health and GET /ready
+type healthReport struct {
+	Status        string                      `json:"status"`
+	Service       string                      `json:"service"`
+	Version       string                      `json:"version"`
+	Build         buildInfo                   `json:"build"`
+	StartedAt     time.Time                   `json:"started_at"`
+	UptimeSeconds float64                     `json:"uptime_seconds"`
+	ActiveRuns    int                         `json:"active_runs"`
+	ShuttingDown  bool                        `json:"shutting_down"`
+	ToolServers   []toolServerHealth          `json:"tool_servers"`
+	Credentials   map[string]credentialHealth `json:"credentials"`
+	Config        configHealth                `json:"config"`
+}
+
+// problems returns why the daemon can't serve chats, if anything
+func (h *healthReport) problems() []string {
+	var problems []string
+	if h.ShuttingDown {
+		problems = append(problems, "the daemon is shutting down")
+	}
+	if !h.Config.Valid {
+		problems = append(problems, "the config file is invalid: "+h.Config.Error)
+	}
+	if !h.Credentials[anthropicProvider].Present {
+		problems = append(problems, "no Anthropic API key is configured")
+	}
+	reachable := false
+	for _, server := range h.ToolServers {
+		reachable = reachable || server.Reachable
+	}
+	if !reachable {
+		problems = append(problems, "no R tool server is reachable")
+	}
+	return problems
+}
+
+// reportHealth checks the daemon's dependencies. The R tool servers are pinged if live is
+// set, and otherwise reported from the latest periodic health checks.
+func (s *ServerClient) reportHealth(ctx context.Context, live bool) *healthReport {
+	report := &healthReport{
+		Service:      "rishi-daemon",
+		Version:      s.opts.Version,
+		Build:        readBuildInfo(),
+		StartedAt:    s.startedAt,
+		ActiveRuns:   s.runs.count(),
+		ShuttingDown: s.runs.isDraining(),
+		Credentials:  s.checkCredentials(),
+		Config:       checkConfigFile(),
+	}
+	if live {
+		report.ToolServers = s.checkToolServers(ctx)
+	} else {
+		report.ToolServers = s.rSessions.cachedHealth()
+	}
+	report.UptimeSeconds = time.Since(s.startedAt).Seconds()
+
+	report.Status = "healthy"
+	if len(report.problems()) > 0 {
+		report.Status = "degraded"
+	}
+	return report
+}
+
+// checkToolServers pings every registered R session's tool server, or the one from the
+// settings if no R session is registered. Sessions busy with a tool call can't answer, so
+// they're reported reachable without a ping.
+func (s *ServerClient) checkToolServers(ctx context.Context) []toolServerHealth {
+	sessions := s.rSessions.List()
+	results := make([]toolServerHealth, len(sessions))
+	servers := make([]toolServer, len(sessions))
+	for i, session := range sessions {
+		results[i] = toolServerHealth{RSessionID: session.ID, Address: session.Address}
+		servers[i] = toolServer{Address: session.Address, Token: session.token}
+		if session.inFlight > 0 {
+			results[i].Reachable, results[i].Busy, results[i].CheckedAt = true, true, time.Now().UTC()
+		}
+	}
+	if len(sessions) == 0 {
+		server := currentToolServer()
+		results = []toolServerHealth{{Address: server.Address}}
+		servers = []toolServer{server}
+	}
+
+	var wg sync.WaitGroup
+	for i := range servers {
+		if results[i].Busy {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkToolServer(ctx, servers[i], &results[i])
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// checkToolServer pings server and records the result in health
+func checkToolServer(ctx context.Context, server toolServer, health *toolServerHealth) error {
+	start := time.Now()
+	err := pingToolServer(ctx, server)
+	health.CheckedAt = start.UTC()
+	health.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	health.Reachable = err == nil
+	health.Error = ""
+	if err != nil {
+		health.Error = err.Error()
+	}
+	return err
+}
+
+// checkCredentials lists the names of each provider's credentials
+func (s *ServerClient) checkCredentials() map[string]credentialHealth {
+	health := map[string]credentialHealth{
+		anthropicProvider: {Names: []string{}},
+	}
+	creds, err := s.opts.Credentials.List("")
+	if err != nil {
+		return health
+	}
+	for _, cred := range creds {
+		provider := health[cred.Provider]
+		provider.Present = true
+		provider.Names = append(provider.Names, cred.Name)
+		health[cred.Provider] = provider
+	}
+	return health
+}
+
+// checkConfigFile reports whether config.json can be read, is a version this daemon
+// understands, and holds valid profiles and settings
+func checkConfigFile() configHealth {
+	path, err := getConfigPath()
+	if err != nil {
+		return configHealth{Error: err.Error()}
+	}
+	health := configHealth{Path: path}
+
+	fields, version, err := readConfigFields(path)
+	health.Version = version
+	if err == nil && version > currentConfigVersion {
+		err = fmt.Errorf("written by a newer version of Rishi (config version %d, this daemon supports %d)", version, currentConfigVersion)
+	}
+	if err == nil {
+		err = validateConfigFields(fields)
+	}
+
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	health.Valid = true
+	return health
+}
+
+// handleHealth reports the daemon's version, uptime and the state of its dependencies. It
+// responds 200 whenever the daemon is up, since it's the liveness check; the status is
+// "degraded" if the daemon can't serve chats. The frontend polls it, so the R tool servers
+// are reported from the periodic health checks rather than pinged, unless ?live=1 is given.
+func (s *ServerClient) handleHealth(w http.ResponseWriter, r *http.Request) {
+	live, _ := strconv.ParseBool(r.URL.Query().Get("live"))
+	report := s.reportHealth(r.Context(), live)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleReady responds 200 if the daemon can serve chats: it isn't shutting down, its
+// config is valid, it has an Anthropic API key and an R tool server is reachable.
+// Otherwise it fails with not_ready, listing the problems and the health report in the
+// error details.
+func (s *ServerClient) handleReady(w http.ResponseWriter, r *http.Request) {
+	report := s.reportHealth(r.Context(), true)
+	if problems := report.problems(); len(problems) > 0 {
+		apiErr := errcode.New(errcode.NotReady, "Rishi isn't ready: "+problems[0])
+		apiErr.Details = map[string]any{"problems": problems, "health": report}
+		writeError(w, r, apiErr)
+		return
+	}
+
+	report.Status = "ready"
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
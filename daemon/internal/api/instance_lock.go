@@ -0,0 +1,74 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// instanceLockFileName is the file in the config directory locked by the running daemon
+const instanceLockFileName = "daemon.lock"
+
+// errInstanceLocked is returned by the platform lock when another process holds the lock
+var errInstanceLocked = errors.New("instance lock is held by another process")
+
+// InstanceLock keeps a second daemon from running against the same config directory. The
+// lock is held by the OS for as long as the file is open, so it's released even if the
+// daemon crashes.
+type InstanceLock struct {
+	file *os.File
+}
+
+// AcquireInstanceLock locks the config directory for this process. It fails if another
+// daemon holds the lock, naming its PID when known.
+func AcquireInstanceLock() (*InstanceLock, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	path := filepath.Join(configDir, instanceLockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open instance lock: %w", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, errInstanceLocked) {
+			if pid := readLockPID(path); pid != 0 {
+				return nil, fmt.Errorf("another daemon (pid %d) is already running with config directory %s", pid, configDir)
+			}
+			return nil, fmt.Errorf("another daemon is already running with config directory %s", configDir)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	// Record our PID for the error message above; the lock itself doesn't depend on it
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	return &InstanceLock{file: file}, nil
+}
+
+// Release unlocks the config directory
+func (l *InstanceLock) Release() {
+	l.file.Truncate(0)
+	unlockFile(l.file)
+	l.file.Close()
+}
+
+// readLockPID returns the PID recorded in the lock file, or 0 if there is none
+func readLockPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
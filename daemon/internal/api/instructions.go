@@ -0,0 +1,157 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// instructionFileName is the name of user- and project-level instruction files
+	instructionFileName = "RISHI.md"
+
+	// maxInstructionFileSize caps how much of an instruction file is sent to the model
+	maxInstructionFileSize = 64 * 1024
+
+	// instructionPollInterval is how often watched instruction files are checked for changes
+	instructionPollInterval = 2 * time.Second
+)
+
+// Instruction file scopes, in increasing order of precedence
+const (
+	instructionScopeUser    = "user"
+	instructionScopeProject = "project"
+)
+
+// instructionFile is a RISHI.md file whose contents are merged into the system prompt
+type instructionFile struct {
+	Path    string `json:"path"`
+	Scope   string `json:"scope"`
+	Bytes   int    `json:"bytes"`
+	content string
+	modTime time.Time
+	exists  bool
+}
+
+// instructionWatcher caches instruction files and polls them for changes so edits to
+// RISHI.md apply to the next chat without rereading every file on every request.
+type instructionWatcher struct {
+	mu    sync.Mutex
+	files map[string]*instructionFile
+	stop  chan struct{}
+}
+
+// newInstructionWatcher creates a watcher and starts polling in the background
+func newInstructionWatcher() *instructionWatcher {
+	w := &instructionWatcher{
+		files: map[string]*instructionFile{},
+		stop:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Close stops the background polling
+func (w *instructionWatcher) Close() {
+	close(w.stop)
+}
+
+func (w *instructionWatcher) run() {
+	ticker := time.NewTicker(instructionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+// poll reloads every watched file whose modification time or size changed
+func (w *instructionWatcher) poll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for path, file := range w.files {
+		stat, err := os.Stat(path)
+		exists := err == nil && !stat.IsDir()
+
+		switch {
+		case !exists && !file.exists:
+			continue
+		case exists && file.exists && stat.ModTime().Equal(file.modTime) && int(stat.Size()) == file.Bytes:
+			continue
+		}
+
+		updated := readInstructionFile(path, file.Scope)
+		w.files[path] = updated
+		log.Info().Str("path", path).Str("scope", file.Scope).Bool("exists", updated.exists).Msg("Instruction file changed")
+	}
+}
+
+// Get returns the instruction file at path, watching it for changes from now on.
+// The second return value is false if the file doesn't exist.
+func (w *instructionWatcher) Get(path, scope string) (instructionFile, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	file, ok := w.files[path]
+	if !ok {
+		file = readInstructionFile(path, scope)
+		w.files[path] = file
+	}
+	return *file, file.exists
+}
+
+// readInstructionFile reads an instruction file, truncating it if it's too large
+func readInstructionFile(path, scope string) *instructionFile {
+	file := &instructionFile{Path: path, Scope: scope}
+
+	stat, err := os.Stat(path)
+	if err != nil || stat.IsDir() {
+		return file
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Warn().Err(err).Str("path", path).Msg("Failed to read instruction file")
+		return file
+	}
+
+	file.exists = true
+	file.modTime = stat.ModTime()
+	file.Bytes = int(stat.Size())
+	file.content = string(data)
+	if len(data) > maxInstructionFileSize {
+		file.content = string(data[:maxInstructionFileSize]) + "\n[... truncated]"
+		log.Warn().Str("path", path).Int("bytes", len(data)).Msg("Instruction file truncated")
+	}
+
+	return file
+}
+
+// Resolve returns the instruction files that apply to a project, lowest precedence first:
+// the user-level RISHI.md in the config directory, then RISHI.md at the project root.
+func (w *instructionWatcher) Resolve(projectRoot string) []instructionFile {
+	var files []instructionFile
+
+	if configDir, err := getConfigDir(); err == nil {
+		if file, ok := w.Get(filepath.Join(configDir, instructionFileName), instructionScopeUser); ok {
+			files = append(files, file)
+		}
+	}
+
+	if projectRoot != "" {
+		if file, ok := w.Get(filepath.Join(projectRoot, instructionFileName), instructionScopeProject); ok {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
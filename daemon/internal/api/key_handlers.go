@@ -0,0 +1,302 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/halliday/rishi/daemon/internal/credentials"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+)
+
+const (
+	validationMaxTokens = 1
+)
+
+// apiKeyStatus describes a stored API key without revealing it
+type apiKeyStatus struct {
+	HasKey          bool       `json:"has_key"`
+	Provider        string     `json:"provider"`
+	Name            string     `json:"name"`
+	Source          string     `json:"source,omitempty"`
+	MaskedKey       string     `json:"masked_key,omitempty"`
+	LastValidatedAt *time.Time `json:"last_validated_at"`
+}
+
+// keyStatus builds the status of a credential, filling in a validation done by this daemon
+// if the store has none recorded
+func (s *ServerClient) keyStatus(cred credentials.Credential) apiKeyStatus {
+	status := apiKeyStatus{
+		HasKey:          true,
+		Provider:        cred.Provider,
+		Name:            cred.Name,
+		Source:          cred.Source,
+		MaskedKey:       maskAPIKey(cred.Secret),
+		LastValidatedAt: cred.ValidatedAt,
+	}
+	if validatedAt, ok := s.keyValidations.Get(cred.Secret); ok && (status.LastValidatedAt == nil || validatedAt.After(*status.LastValidatedAt)) {
+		status.LastValidatedAt = &validatedAt
+	}
+	return status
+}
+
+// credentialRefFromName returns the Anthropic credential with the given name, or the default
+// credential if name is empty
+func credentialRefFromName(name string) (credentials.Ref, *errcode.Error) {
+	ref := defaultCredentialRef
+	if name != "" {
+		ref.Name = strings.ToLower(name)
+	}
+	if err := ref.Validate(); err != nil {
+		return ref, errcode.New(errcode.InvalidRequest, err.Error())
+	}
+	return ref, nil
+}
+
+// handleGetAPIKey reports whether an API key is stored, under the name given by the "name"
+// query parameter or the default one. The key itself never leaves the daemon; chats without
+// an X-Anthropic-API-Key header use it server-side.
+func (s *ServerClient) handleGetAPIKey(w http.ResponseWriter, r *http.Request) {
+	ref, apiErr := credentialRefFromName(r.URL.Query().Get("name"))
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	status := apiKeyStatus{Provider: ref.Provider, Name: ref.Name}
+	cred, err := s.opts.Credentials.Get(ref)
+	switch {
+	case err == nil:
+		status = s.keyStatus(cred)
+	case !errors.Is(err, credentials.ErrNotFound):
+		ctxLog(r.Context()).Error().Err(err).Msg("Failed to get API key")
+		writeError(w, r, errcode.New(errcode.ConfigError, "failed to read the credential store"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleListAPIKeys lists every stored Anthropic API key, masked
+func (s *ServerClient) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	creds, err := s.opts.Credentials.List(anthropicProvider)
+	if err != nil {
+		ctxLog(r.Context()).Error().Err(err).Msg("Failed to list API keys")
+		writeError(w, r, errcode.New(errcode.ConfigError, "failed to read the credential store"))
+		return
+	}
+
+	keys := make([]apiKeyStatus, 0, len(creds))
+	for _, cred := range creds {
+		keys = append(keys, s.keyStatus(cred))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+// handleDeleteAPIKey removes a stored API key, named by the "name" query parameter or the
+// default one
+func (s *ServerClient) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	ref, apiErr := credentialRefFromName(r.URL.Query().Get("name"))
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	if err := s.opts.Credentials.Delete(ref); err != nil {
+		switch {
+		case errors.Is(err, credentials.ErrNotFound):
+			// Deleting a key set by environment variable is reported as not found in the file
+			if cred, getErr := s.opts.Credentials.Get(ref); getErr == nil && cred.Source == "env" {
+				writeError(w, r, errcode.New(errcode.ConfigError, "this API key is set by an environment variable and can't be deleted here"))
+				return
+			}
+			writeError(w, r, errcode.New(errcode.NotFound, "no API key is stored under this name"))
+		default:
+			ctxLog(r.Context()).Error().Err(err).Msg("Failed to delete API key")
+			writeError(w, r, errcode.New(errcode.ConfigError, "failed to delete API key"))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// keyValidations remembers when keys were last validated by this daemon, so that a key
+// validated before it's saved is stored with its validation time
+type keyValidations struct {
+	mu sync.Mutex
+	at map[[sha256.Size]byte]time.Time
+}
+
+func newKeyValidations() *keyValidations {
+	return &keyValidations{at: map[[sha256.Size]byte]time.Time{}}
+}
+
+// Record notes that apiKey was validated now
+func (v *keyValidations) Record(apiKey string) time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	now := time.Now().UTC()
+	v.at[sha256.Sum256([]byte(apiKey))] = now
+	return now
+}
+
+// Get returns when apiKey was last validated, if it has been
+func (v *keyValidations) Get(apiKey string) (time.Time, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	at, ok := v.at[sha256.Sum256([]byte(apiKey))]
+	return at, ok
+}
+
+// handleValidateAPIKey validates an API key against the Anthropic API. Without a key in
+// the body, it validates the stored key with the given name, or the default one.
+func (s *ServerClient) handleValidateAPIKey(w http.ResponseWriter, r *http.Request) {
+	type reqBody struct {
+		APIKey string `json:"api_key"`
+		Name   string `json:"name"`
+	}
+	var in reqBody
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "invalid request body"))
+		return
+	}
+
+	var stored *credentials.Credential
+	if in.APIKey == "" {
+		ref, apiErr := credentialRefFromName(in.Name)
+		if apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		cred, err := s.opts.Credentials.Get(ref)
+		if err != nil {
+			if !errors.Is(err, credentials.ErrNotFound) {
+				ctxLog(r.Context()).Error().Err(err).Msg("Failed to load stored API key")
+			}
+			writeError(w, r, errcode.New(errcode.MissingAPIKey, "missing api_key parameter and no API key is stored"))
+			return
+		}
+		stored = &cred
+		in.APIKey = cred.Secret
+	}
+
+	if apiErr := ValidateAPIKey(r.Context(), in.APIKey); apiErr != nil {
+		writeValidationResult(w, r, apiErr)
+		return
+	}
+
+	validatedAt := s.keyValidations.Record(in.APIKey)
+	if stored != nil && stored.Source != "env" {
+		stored.ValidatedAt = &validatedAt
+		if err := s.opts.Credentials.Set(*stored); err != nil {
+			ctxLog(r.Context()).Warn().Err(err).Msg("Failed to record API key validation time")
+		}
+	}
+
+	writeValidationResult(w, r, nil)
+}
+
+// ValidateAPIKey checks an Anthropic API key's format and that Anthropic accepts it,
+// returning an invalid_api_key error if not
+func ValidateAPIKey(ctx context.Context, apiKey string) *errcode.Error {
+	// Basic format validation
+	if !strings.HasPrefix(apiKey, "sk-ant-") || len(apiKey) < 20 {
+		return errcode.New(errcode.InvalidAPIKey, "API key is not in the expected sk-ant-... format")
+	}
+
+	// Test the API key with Anthropic API
+	testClient := anthropic.NewClient(
+		option.WithAPIKey(apiKey),
+	)
+
+	_, err := testClient.Messages.New(ctx, anthropic.MessageNewParams{
+		Model:     anthropic.ModelClaude3_5HaikuLatest,
+		MaxTokens: int64(validationMaxTokens),
+		Messages: []anthropic.MessageParam{
+			anthropic.NewUserMessage(anthropic.NewTextBlock("hi")),
+		},
+	})
+
+	// Both 200 (success) and 400 (validation error) mean the API key is valid
+	// Only authentication errors (401) mean the key is invalid
+	if err != nil && strings.Contains(err.Error(), "401") {
+		return errcode.New(errcode.InvalidAPIKey, "Anthropic rejected the API key")
+	}
+	return nil
+}
+
+// writeValidationResult writes {"valid": true}, or {"valid": false} with an error envelope
+// explaining why. Validation failures are results rather than request errors, so both use 200.
+func writeValidationResult(w http.ResponseWriter, r *http.Request, apiErr *errcode.Error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if apiErr == nil {
+		json.NewEncoder(w).Encode(map[string]bool{"valid": true})
+		return
+	}
+	apiErr.RequestID = requestIDFromContext(r.Context())
+	json.NewEncoder(w).Encode(map[string]any{"valid": false, "error": apiErr})
+}
+
+// handleSetAPIKey saves an API key to the encrypted credential store, under the given name
+// or the default one
+func (s *ServerClient) handleSetAPIKey(w http.ResponseWriter, r *http.Request) {
+	type reqBody struct {
+		APIKey string `json:"api_key"`
+		Name   string `json:"name"`
+	}
+	var in reqBody
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "invalid request body"))
+		return
+	}
+
+	if in.APIKey == "" {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "missing api_key parameter"))
+		return
+	}
+	ref, apiErr := credentialRefFromName(in.Name)
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	// An environment variable takes precedence over the file, so a saved key would never be used
+	if existing, err := s.opts.Credentials.Get(ref); err == nil && existing.Source == "env" {
+		writeError(w, r, errcode.New(errcode.Conflict, "this API key is set by an environment variable, which takes precedence over a saved key; unset the variable to save one here").WithDetail("credential", ref.String()))
+		return
+	}
+
+	cred := credentials.Credential{Provider: ref.Provider, Name: ref.Name, Secret: in.APIKey}
+	// Keep the validation time if the frontend validated this key before saving it
+	if validatedAt, ok := s.keyValidations.Get(in.APIKey); ok {
+		cred.ValidatedAt = &validatedAt
+	}
+	if err := s.opts.Credentials.Set(cred); err != nil {
+		ctxLog(r.Context()).Error().Err(err).Msg("Failed to save API key")
+		writeError(w, r, errcode.New(errcode.ConfigError, "failed to save API key"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/halliday/rishi/daemon/internal/metrics"
+)
+
+// Chat request outcomes other than error codes
+const (
+	chatOutcomeCompleted = "completed"
+)
+
+// Tool call outcomes
+const (
+	toolOutcomeSuccess = "success"
+	toolOutcomeError   = "error"
+)
+
+// Buckets for model latencies, which run from under a second to several minutes
+var modelLatencyBuckets = []float64{0.25, 0.5, 1, 2, 4, 8, 15, 30, 60, 120, 300}
+
+var (
+	chatRequestsTotal = metrics.NewCounterVec("rishi_chat_requests_total",
+		"Chat requests handled, by outcome: completed or the error code the run failed with.",
+		"outcome")
+	activeRuns = metrics.NewGauge("rishi_active_runs",
+		"Chat runs currently in progress.")
+
+	modelTurnDuration = metrics.NewHistogramVec("rishi_model_turn_duration_seconds",
+		"Time to complete a model turn, including retries.",
+		modelLatencyBuckets, "model", "outcome")
+	modelTimeToFirstToken = metrics.NewHistogramVec("rishi_model_time_to_first_token_seconds",
+		"Time from sending a model request to receiving its first streamed delta.",
+		modelLatencyBuckets, "model")
+	modelRetriesTotal = metrics.NewCounterVec("rishi_model_retries_total",
+		"Model requests retried after a transient provider error, by error code.",
+		"model", "code")
+	modelTokensTotal = metrics.NewCounterVec("rishi_model_tokens_total",
+		"Tokens used by model and type: input, output, cache_read or cache_creation.",
+		"model", "type")
+
+	toolCallsTotal = metrics.NewCounterVec("rishi_tool_calls_total",
+		"Tool calls executed, by tool and outcome: success or error.",
+		"tool", "outcome")
+	toolCallDuration = metrics.NewHistogramVec("rishi_tool_call_duration_seconds",
+		"Time to execute a tool call.",
+		nil, "tool")
+
+	rToolServerRequestDuration = metrics.NewHistogramVec("rishi_r_tool_server_request_duration_seconds",
+		"Latency of requests to the R tool server, by endpoint.",
+		nil, "endpoint")
+	rToolServerErrorsTotal = metrics.NewCounterVec("rishi_r_tool_server_errors_total",
+		"Failed requests to the R tool server, by endpoint.",
+		"endpoint")
+)
+
+// recordTokenUsage adds a model turn's token usage to the token counters
+func recordTokenUsage(record usageRecord) {
+	modelTokensTotal.Add(float64(record.InputTokens), record.Model, "input")
+	modelTokensTotal.Add(float64(record.OutputTokens), record.Model, "output")
+	modelTokensTotal.Add(float64(record.CacheReadInputTokens), record.Model, "cache_read")
+	modelTokensTotal.Add(float64(record.CacheCreationInputTokens), record.Model, "cache_creation")
+}
+
+// handleMetrics serves the daemon's metrics in the Prometheus text format
+func (s *ServerClient) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics.Default.Handler().ServeHTTP(w, r)
+}
@@ -1,14 +1,44 @@
 package api
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultAllowedOrigins are the origins the addin's frontend is served from
+var DefaultAllowedOrigins = []string{"http://127.0.0.1:8081", "http://localhost:8081"}
+
+// CORS returns a middleware that allows cross-origin requests from the given origins, or those
+// isAllowed accepts if it's not nil, and handles OPTIONS preflight. Browser requests from any
+// other origin are rejected outright, so a web page can't drive the daemon even with a simple
+// request that skips preflight.
+func CORS(allowedOrigins []string, isAllowed func(origin string) bool) func(http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, origin := range allowedOrigins {
+		allowed[strings.TrimRight(origin, "/")] = true
+	}
 
-// CORS returns a middleware that adds permissive CORS headers and handles OPTIONS preflight.
-func CORS() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,X-Model,X-Anthropic-API-Key")
+			w.Header().Add("Vary", "Origin")
+			origin := r.Header.Get("Origin")
+			if origin != "" {
+				if !allowed[origin] && (isAllowed == nil || !isAllowed(origin)) {
+					writeError(w, r, errcode.New(errcode.ForbiddenOrigin, "origin not allowed: "+origin))
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization,Content-Type,X-Model,X-Anthropic-API-Key,X-Session-ID,X-R-Session-ID,X-Request-ID,X-Rishi-Token")
+				w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID,X-Rishi-Run-ID")
+			}
 			if r.Method == http.MethodOptions {
 				w.WriteHeader(http.StatusNoContent)
 				return
@@ -17,3 +47,96 @@ func CORS() func(http.Handler) http.Handler {
 		})
 	}
 }
+
+type requestIDKey struct{}
+
+// RequestID returns a middleware that assigns each request an ID, taken from the X-Request-ID
+// header when the client supplies one, and echoes it back in the response headers.
+func RequestID() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get("X-Request-ID")
+			if id == "" || len(id) > 128 {
+				id = newID()
+			}
+			w.Header().Set("X-Request-ID", id)
+
+			ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+			ctx = log.With().Str("request_id", id).Logger().WithContext(ctx)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// requestIDFromContext returns the request ID assigned by the RequestID middleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestLogger returns a middleware that logs each request's method, path, status and duration.
+// It must run after RequestID so the log line carries the request ID.
+func RequestLogger() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			// /health is polled by the frontend and /metrics by scrapers, so keep them out of
+			// the default log level
+			event := ctxLog(r.Context()).Info()
+			if r.URL.Path == "/health" || r.URL.Path == "/metrics" {
+				event = ctxLog(r.Context()).Debug()
+			}
+			event.
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Int("status", ww.Status()).
+				Int("bytes", ww.BytesWritten()).
+				Dur("duration", time.Since(start)).
+				Msg("request completed")
+		})
+	}
+}
+
+type runKey struct{}
+
+// withRun marks ctx as belonging to an agent run, adding the run and session IDs to its logger
+func withRun(ctx context.Context, runID, sessionID string) context.Context {
+	ctx = context.WithValue(ctx, runKey{}, runID)
+	logCtx := ctxLog(ctx).With().Str("run_id", runID)
+	if sessionID != "" {
+		logCtx = logCtx.Str("session_id", sessionID)
+	}
+	return logCtx.Logger().WithContext(ctx)
+}
+
+// runIDFromContext returns the run ID set by withRun
+func runIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(runKey{}).(string)
+	return id
+}
+
+type toolUseKey struct{}
+
+// withToolUse marks ctx as belonging to a tool call, adding its ID and name to the logger
+func withToolUse(ctx context.Context, toolUseID, name string) context.Context {
+	ctx = context.WithValue(ctx, toolUseKey{}, toolUseID)
+	return ctxLog(ctx).With().Str("tool_use_id", toolUseID).Str("tool", name).Logger().WithContext(ctx)
+}
+
+// toolUseIDFromContext returns the tool use ID set by withToolUse
+func toolUseIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(toolUseKey{}).(string)
+	return id
+}
+
+// ctxLog returns the logger carried by ctx, which includes request and run IDs,
+// falling back to the global logger
+func ctxLog(ctx context.Context) *zerolog.Logger {
+	if logger := zerolog.Ctx(ctx); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &log.Logger
+}
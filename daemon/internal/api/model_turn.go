@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/halliday/rishi/daemon/internal/tracing"
+)
+
+// runModelTurn sends one model request, retrying transient provider errors (overloaded,
+// rate limited, 5xx, network resets) with jittered exponential backoff. Each retry is
+// announced to the frontend with a retrying event. Attempts that fail after the model
+// started responding are passed to recordPartial, since their tokens are still billed.
+func runModelTurn(ctx context.Context, client *anthropic.Client, params anthropic.MessageNewParams, w http.ResponseWriter, flusher http.Flusher, recordPartial func(anthropic.Message)) (anthropic.Message, error) {
+	model := string(params.Model)
+	ctx, span := tracing.Start(ctx, "model.turn", tracing.SpanKindInternal,
+		tracing.String("gen_ai.system", "anthropic"),
+		tracing.String("gen_ai.request.model", model),
+		tracing.Int64("gen_ai.request.max_tokens", params.MaxTokens),
+	)
+	defer span.End()
+
+	logger := ctxLog(ctx)
+	turnStart := time.Now()
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		streamCtx, streamSpan := tracing.Start(ctx, "model.stream", tracing.SpanKindClient,
+			tracing.String("gen_ai.request.model", model),
+			tracing.Int("rishi.attempt", attempt+1),
+		)
+		message, streamed, err := streamModelTurn(streamCtx, client, params, w, flusher)
+		streamSpan.SetAttributes(tracing.Bool("rishi.streamed", streamed))
+		streamSpan.RecordError(err)
+		streamSpan.End()
+
+		if err == nil {
+			logger.Info().
+				Str("model", string(message.Model)).
+				Str("stop_reason", string(message.StopReason)).
+				Int64("input_tokens", message.Usage.InputTokens).
+				Int64("output_tokens", message.Usage.OutputTokens).
+				Int("attempt", attempt+1).
+				Dur("duration", time.Since(start)).
+				Msg("model turn completed")
+			modelTurnDuration.ObserveDuration(time.Since(turnStart), model, chatOutcomeCompleted)
+			span.SetAttributes(
+				tracing.String("gen_ai.response.model", string(message.Model)),
+				tracing.String("gen_ai.response.finish_reason", string(message.StopReason)),
+				tracing.Int64("gen_ai.usage.input_tokens", message.Usage.InputTokens),
+				tracing.Int64("gen_ai.usage.output_tokens", message.Usage.OutputTokens),
+				tracing.Int64("rishi.usage.cache_read_input_tokens", message.Usage.CacheReadInputTokens),
+				tracing.Int64("rishi.usage.cache_creation_input_tokens", message.Usage.CacheCreationInputTokens),
+				tracing.Int("rishi.attempts", attempt+1),
+			)
+			return message, nil
+		}
+
+		if message.Usage.InputTokens > 0 || message.Usage.OutputTokens > 0 {
+			recordPartial(message)
+		}
+
+		perr := classifyProviderError(err)
+		if !perr.Retryable || attempt >= maxModelRetries || perr.RetryAfter > maxRetryWait {
+			modelTurnDuration.ObserveDuration(time.Since(turnStart), model, string(perr.Code))
+			span.SetAttributes(tracing.String("error.type", string(perr.Code)), tracing.Int("rishi.attempts", attempt+1))
+			span.RecordError(perr)
+			return message, perr
+		}
+
+		wait := retryBackoff(attempt, perr.RetryAfter)
+		logger.Warn().Err(err).Str("error_code", string(perr.Code)).Int("attempt", attempt+1).Dur("wait", wait).Msg("Retrying model turn")
+		streamRetrying(w, flusher, attempt+1, wait, perr, streamed)
+		modelRetriesTotal.Inc(model, string(perr.Code))
+
+		select {
+		case <-ctx.Done():
+			modelTurnDuration.ObserveDuration(time.Since(turnStart), model, string(errcode.Canceled))
+			span.SetAttributes(tracing.String("error.type", string(errcode.Canceled)), tracing.Int("rishi.attempts", attempt+1))
+			span.RecordError(ctx.Err())
+			return message, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// streamModelTurn sends one model request and streams text, thinking and tool input deltas
+// to the frontend as they arrive. It also reports whether anything was streamed, so that a
+// retry can tell the frontend to discard the failed attempt's partial output.
+func streamModelTurn(ctx context.Context, client *anthropic.Client, params anthropic.MessageNewParams, w http.ResponseWriter, flusher http.Flusher) (anthropic.Message, bool, error) {
+	start := time.Now()
+	stream := client.Messages.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	message := anthropic.Message{}
+	streamed := false
+	receivedDelta := false
+	// Tool use blocks being generated in this turn, keyed by content block index
+	streamingToolUses := map[int64]anthropic.ToolUseBlock{}
+	for stream.Next() {
+		event := stream.Current()
+		if err := message.Accumulate(event); err != nil {
+			ctxLog(ctx).Error().Err(err).Msg("message accumulation error")
+			return message, streamed, err
+		}
+
+		switch eventVariant := event.AsAny().(type) {
+		case anthropic.ContentBlockStartEvent:
+			if toolUse, ok := eventVariant.ContentBlock.AsAny().(anthropic.ToolUseBlock); ok {
+				streamingToolUses[eventVariant.Index] = toolUse
+			}
+		case anthropic.ContentBlockDeltaEvent:
+			if !receivedDelta {
+				receivedDelta = true
+				ttft := time.Since(start)
+				modelTimeToFirstToken.ObserveDuration(ttft, string(params.Model))
+				tracing.SpanFromContext(ctx).SetAttributes(tracing.Float64("rishi.time_to_first_token_ms", float64(ttft.Microseconds())/1000))
+			}
+			switch deltaVariant := eventVariant.Delta.AsAny().(type) {
+			case anthropic.TextDelta:
+				_ = json.NewEncoder(w).Encode(map[string]any{"text": deltaVariant.Text})
+				flusher.Flush()
+				streamed = true
+			case anthropic.InputJSONDelta:
+				if toolUse, ok := streamingToolUses[eventVariant.Index]; ok && deltaVariant.PartialJSON != "" {
+					streamToolInputDelta(w, flusher, toolUse.ID, toolUse.Name, deltaVariant.PartialJSON)
+					streamed = true
+				}
+			case anthropic.ThinkingDelta:
+				_ = json.NewEncoder(w).Encode(map[string]any{"thinking": deltaVariant.Thinking})
+				flusher.Flush()
+				streamed = true
+			}
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		return message, streamed, err
+	}
+	return message, streamed, nil
+}
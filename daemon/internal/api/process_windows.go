@@ -0,0 +1,24 @@
+//go:build windows
+
+package api
+
+import "golang.org/x/sys/windows"
+
+// stillActive is the exit code Windows reports for a process that hasn't exited
+const stillActive = 259
+
+// processAlive reports whether a process with the given PID exists
+func processAlive(pid int) bool {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Access is denied to processes of other users, which still exist
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(handle)
+
+	var code uint32
+	if err := windows.GetExitCodeProcess(handle, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+)
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-]*$`)
+
+// namedProfile is a profile as listed by the API
+type namedProfile struct {
+	Name string `json:"name"`
+	Profile
+	Default bool `json:"default"`
+}
+
+// errProfileNotFound is returned by profile updates when the profile doesn't exist
+var errProfileNotFound = errors.New("profile not found")
+
+// validateProfile checks a profile's settings, filling in the default provider and
+// normalizing the credential reference
+func validateProfile(p *Profile) error {
+	if p.Provider == "" {
+		p.Provider = anthropicProvider
+	}
+	if p.Provider != anthropicProvider {
+		return fmt.Errorf("unsupported provider %q", p.Provider)
+	}
+	if p.Credential != "" {
+		ref, err := ParseAnthropicRef(p.Credential)
+		if err != nil {
+			return err
+		}
+		p.Credential = ref.String()
+	}
+	if p.MaxTokens < 0 {
+		return errors.New("max_tokens must not be negative")
+	}
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 1) {
+		return errors.New("temperature must be between 0 and 1")
+	}
+	if p.BaseURL != "" {
+		u, err := url.Parse(p.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("base_url must be an http or https URL")
+		}
+	}
+	return nil
+}
+
+// resolveProfile returns the named profile, or the default profile if name is empty. With
+// no name and no default profile, it returns an empty profile. Profiles come from the
+// current settings snapshot, which follows config.json.
+func resolveProfile(name string) (string, Profile, *errcode.Error) {
+	profiles, defaultProfile := currentProfiles()
+
+	if name == "" {
+		name = defaultProfile
+		if name == "" {
+			return "", Profile{}, nil
+		}
+		if _, ok := profiles[name]; !ok {
+			return "", Profile{}, errcode.New(errcode.ConfigError, "the default profile "+name+" doesn't exist")
+		}
+	}
+
+	profile, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		return "", Profile{}, errcode.New(errcode.NotFound, "no profile is named "+name)
+	}
+	return strings.ToLower(name), profile, nil
+}
+
+// handleListProfiles lists the configured profiles and the default one
+func (s *ServerClient) handleListProfiles(w http.ResponseWriter, r *http.Request) {
+	config, err := LoadConfig()
+	if err != nil {
+		ctxLog(r.Context()).Error().Err(err).Msg("Failed to load config")
+		writeError(w, r, errcode.New(errcode.ConfigError, "failed to read config"))
+		return
+	}
+
+	profiles := make([]namedProfile, 0, len(config.Profiles))
+	for name, profile := range config.Profiles {
+		profiles = append(profiles, namedProfile{Name: name, Profile: profile, Default: name == config.DefaultProfile})
+	}
+	slices.SortFunc(profiles, func(a, b namedProfile) int { return strings.Compare(a.Name, b.Name) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{
+		"default_profile": config.DefaultProfile,
+		"profiles":        profiles,
+	})
+}
+
+// handleSetProfile creates or replaces a profile, optionally making it the default
+func (s *ServerClient) handleSetProfile(w http.ResponseWriter, r *http.Request) {
+	var in namedProfile
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "invalid request body"))
+		return
+	}
+
+	in.Name = strings.ToLower(in.Name)
+	if !profileNamePattern.MatchString(in.Name) {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "profile name must be lowercase letters, digits, '-' or '_'"))
+		return
+	}
+	if err := validateProfile(&in.Profile); err != nil {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, err.Error()))
+		return
+	}
+
+	var saved *Config
+	err := updateConfig(func(config *Config) error {
+		if config.Profiles == nil {
+			config.Profiles = map[string]Profile{}
+		}
+		config.Profiles[in.Name] = in.Profile
+		if in.Default {
+			config.DefaultProfile = in.Name
+		}
+		saved = config
+		return nil
+	})
+	if err != nil {
+		ctxLog(r.Context()).Error().Err(err).Str("profile", in.Name).Msg("Failed to save profile")
+		writeError(w, r, errcode.New(errcode.ConfigError, "failed to save profile"))
+		return
+	}
+	storeProfiles(saved)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
+
+// handleDeleteProfile removes a profile. Deleting the default profile leaves no default.
+func (s *ServerClient) handleDeleteProfile(w http.ResponseWriter, r *http.Request) {
+	name := strings.ToLower(chi.URLParam(r, "name"))
+
+	var saved *Config
+	err := updateConfig(func(config *Config) error {
+		if _, ok := config.Profiles[name]; !ok {
+			return errProfileNotFound
+		}
+		delete(config.Profiles, name)
+		if config.DefaultProfile == name {
+			config.DefaultProfile = ""
+		}
+		saved = config
+		return nil
+	})
+	switch {
+	case errors.Is(err, errProfileNotFound):
+		writeError(w, r, errcode.New(errcode.NotFound, "no profile is named "+name))
+		return
+	case err != nil:
+		ctxLog(r.Context()).Error().Err(err).Str("profile", name).Msg("Failed to delete profile")
+		writeError(w, r, errcode.New(errcode.ConfigError, "failed to delete profile"))
+		return
+	}
+	storeProfiles(saved)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
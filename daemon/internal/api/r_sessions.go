@@ -0,0 +1,443 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// rSessionHealthTimeout bounds each R session health check, and a session is dropped
+	// after rSessionMaxFailures checks in a row fail
+	rSessionHealthTimeout = 2 * time.Second
+	rSessionMaxFailures   = 3
+
+	// rSessionBindingTTL is how long a chat session's R session binding outlives the chat
+	// session's last run. The frontend starts a new chat session on every page load and
+	// never says when one ends.
+	rSessionBindingTTL = 12 * time.Hour
+)
+
+// rSession is an R session whose tool server has registered with the daemon
+type rSession struct {
+	ID          string `json:"id"`
+	Address     string `json:"address"`
+	ProjectRoot string `json:"project_root"`
+	PID         int    `json:"pid"`
+	// Origin is where the session serves the frontend from, allowed by CORS while the
+	// session is registered
+	Origin       string    `json:"origin,omitempty"`
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeenAt   time.Time `json:"last_seen_at"`
+
+	token    string
+	failures int
+	// health is the result of the latest health check, reported by GET /health
+	health toolServerHealth
+	// inFlight counts tool server requests underway. R answers one request at a time, so
+	// health checks can't get through while a tool call runs.
+	inFlight int
+}
+
+// rSessionBinding routes a chat session's tool calls to an R session
+type rSessionBinding struct {
+	rSessionID string
+	lastUsed   time.Time
+}
+
+// rSessionRegistry tracks the registered R sessions and which R session each chat session
+// is bound to
+type rSessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*rSession
+	// bindings maps chat session IDs to the R sessions they're bound to
+	bindings map[string]rSessionBinding
+	// fallbackHealth is the latest health check of the tool server from the settings, which
+	// is checked while no session is registered
+	fallbackHealth toolServerHealth
+}
+
+func newRSessionRegistry() *rSessionRegistry {
+	return &rSessionRegistry{
+		sessions: map[string]*rSession{},
+		bindings: map[string]rSessionBinding{},
+	}
+}
+
+// Register adds or replaces a session, keeping its registration time if it was already known
+func (reg *rSessionRegistry) Register(session rSession) rSession {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	now := time.Now().UTC()
+	session.RegisteredAt = now
+	session.LastSeenAt = now
+	if existing, ok := reg.sessions[session.ID]; ok {
+		session.RegisteredAt = existing.RegisteredAt
+	}
+	reg.sessions[session.ID] = &session
+	return session
+}
+
+// Remove drops a session and its chat bindings, reporting whether it was registered
+func (reg *rSessionRegistry) Remove(id string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if _, ok := reg.sessions[id]; !ok {
+		return false
+	}
+	delete(reg.sessions, id)
+	for chatSession, binding := range reg.bindings {
+		if binding.rSessionID == id {
+			delete(reg.bindings, chatSession)
+		}
+	}
+	return true
+}
+
+// expireBindings drops the bindings of chat sessions that haven't started a run in
+// rSessionBindingTTL
+func (reg *rSessionRegistry) expireBindings(now time.Time) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for chatSession, binding := range reg.bindings {
+		if now.Sub(binding.lastUsed) > rSessionBindingTTL {
+			delete(reg.bindings, chatSession)
+		}
+	}
+}
+
+// beginRequest marks a tool server request to an R session as underway. endRequest must be
+// called once it's done; any response from the tool server shows that the session is alive.
+func (reg *rSessionRegistry) beginRequest(id string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if session, ok := reg.sessions[id]; ok {
+		session.inFlight++
+	}
+}
+
+func (reg *rSessionRegistry) endRequest(id string, responded bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	session, ok := reg.sessions[id]
+	if !ok {
+		return
+	}
+	if session.inFlight > 0 {
+		session.inFlight--
+	}
+	if responded {
+		session.failures = 0
+		session.LastSeenAt = time.Now().UTC()
+	}
+}
+
+// List returns the registered sessions ordered by registration time
+func (reg *rSessionRegistry) List() []rSession {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	sessions := make([]rSession, 0, len(reg.sessions))
+	for _, session := range reg.sessions {
+		sessions = append(sessions, *session)
+	}
+	slices.SortFunc(sessions, func(a, b rSession) int { return a.RegisteredAt.Compare(b.RegisteredAt) })
+	return sessions
+}
+
+// HasOrigin reports whether a registered session serves the frontend from origin
+func (reg *rSessionRegistry) HasOrigin(origin string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, session := range reg.sessions {
+		if session.Origin != "" && session.Origin == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the tool server for a chat session's tool calls. An explicit R session ID
+// binds the chat session to it; otherwise the chat session's earlier binding is used, or
+// the only registered session if there's just one. With no registered sessions it returns
+// the tool server from the settings.
+func (reg *rSessionRegistry) Resolve(chatSessionID, rSessionID string) (toolServer, *errcode.Error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if rSessionID == "" && chatSessionID != "" {
+		rSessionID = reg.bindings[chatSessionID].rSessionID
+	}
+	if rSessionID == "" {
+		switch len(reg.sessions) {
+		case 0:
+			return currentToolServer(), nil
+		case 1:
+			for id := range reg.sessions {
+				rSessionID = id
+			}
+		default:
+			return toolServer{}, errcode.New(errcode.InvalidRequest, "several R sessions are registered; choose one with the X-R-Session-ID header")
+		}
+	}
+
+	session, ok := reg.sessions[rSessionID]
+	if !ok {
+		return toolServer{}, errcode.New(errcode.NotFound, "R session "+rSessionID+" is not registered; restart Rishi from RStudio").WithDetail("r_session_id", rSessionID)
+	}
+	if chatSessionID != "" {
+		reg.bindings[chatSessionID] = rSessionBinding{rSessionID: rSessionID, lastUsed: time.Now()}
+	}
+	return toolServer{Address: session.Address, Token: session.token, rSessions: reg, rSessionID: rSessionID}, nil
+}
+
+// checkHealth probes every session's tool server, dropping sessions that have failed
+// rSessionMaxFailures checks in a row, or the tool server from the settings if no session
+// is registered. Sessions busy with a tool call are skipped, since R can't answer until
+// the call returns.
+func (reg *rSessionRegistry) checkHealth(ctx context.Context) {
+	reg.expireBindings(time.Now())
+
+	sessions := reg.List()
+	if len(sessions) == 0 {
+		server := currentToolServer()
+		health := toolServerHealth{Address: server.Address}
+		checkToolServer(ctx, server, &health)
+		reg.mu.Lock()
+		reg.fallbackHealth = health
+		reg.mu.Unlock()
+		return
+	}
+
+	for _, session := range sessions {
+		if session.inFlight > 0 {
+			continue
+		}
+		health := toolServerHealth{RSessionID: session.ID, Address: session.Address}
+		err := checkToolServer(ctx, toolServer{Address: session.Address, Token: session.token}, &health)
+
+		reg.mu.Lock()
+		current, ok := reg.sessions[session.ID]
+		if !ok {
+			reg.mu.Unlock()
+			continue
+		}
+		if err == nil {
+			current.failures = 0
+			current.LastSeenAt = time.Now().UTC()
+			current.health = health
+			reg.mu.Unlock()
+			continue
+		}
+		if current.inFlight > 0 {
+			// A tool call started while the check was waiting on R
+			reg.mu.Unlock()
+			continue
+		}
+		current.failures++
+		current.health = health
+		drop := current.failures >= rSessionMaxFailures
+		reg.mu.Unlock()
+
+		logger := log.With().Str("r_session_id", session.ID).Str("address", session.Address).Logger()
+		if drop {
+			logger.Warn().Err(err).Msg("Dropping R session that stopped responding")
+			reg.Remove(session.ID)
+		} else {
+			logger.Debug().Err(err).Msg("R session health check failed")
+		}
+	}
+}
+
+// cachedHealth returns the latest health check of each session's tool server, or of the
+// tool server from the settings if no session is registered. A session busy with a tool
+// call, or that answered one since it was last checked, is reachable.
+func (reg *rSessionRegistry) cachedHealth() []toolServerHealth {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if len(reg.sessions) == 0 {
+		if reg.fallbackHealth.CheckedAt.IsZero() {
+			return []toolServerHealth{{Address: currentToolServer().Address, Error: "not checked yet"}}
+		}
+		return []toolServerHealth{reg.fallbackHealth}
+	}
+
+	sessions := slices.SortedFunc(maps.Values(reg.sessions), func(a, b *rSession) int { return a.RegisteredAt.Compare(b.RegisteredAt) })
+	results := make([]toolServerHealth, 0, len(sessions))
+	for _, session := range sessions {
+		health := session.health
+		health.RSessionID, health.Address = session.ID, session.Address
+		if health.CheckedAt.IsZero() {
+			// The session registered itself once its tool server was listening
+			health.CheckedAt = session.RegisteredAt
+		}
+		health.Busy = session.inFlight > 0
+		health.Reachable = session.failures == 0
+		if health.Reachable {
+			health.Error = ""
+		}
+		results = append(results, health)
+	}
+	return results
+}
+
+// pingToolServer checks that a tool server answers its health check
+func pingToolServer(ctx context.Context, server toolServer) error {
+	ctx, cancel := context.WithTimeout(ctx, rSessionHealthTimeout)
+	defer cancel()
+
+	client, baseURL := server.client()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	if server.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+server.Token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &toolServerStatusError{StatusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// MonitorRSessions health-checks the registered R sessions now and every interval until
+// ctx is done
+func (s *ServerClient) MonitorRSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.rSessions.checkHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type toolServerKey struct{}
+
+// withToolServer routes the tool calls made with ctx to server
+func withToolServer(ctx context.Context, server toolServer) context.Context {
+	return context.WithValue(ctx, toolServerKey{}, server)
+}
+
+// toolServerFromContext returns the tool server set by withToolServer, or the one from the
+// settings
+func toolServerFromContext(ctx context.Context) toolServer {
+	if server, ok := ctx.Value(toolServerKey{}).(toolServer); ok {
+		return server
+	}
+	return currentToolServer()
+}
+
+// validateLoopbackOrigin checks that origin is an http origin on this machine
+func validateLoopbackOrigin(origin string) error {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "http" || u.Path != "" || u.Port() == "" {
+		return errors.New("origin must be http://host:port")
+	}
+	if host := u.Hostname(); host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return errors.New("origin must be on loopback")
+		}
+	}
+	return nil
+}
+
+// handleRegisterRSession registers an R session's tool server. Registering an existing ID
+// updates it, so the addin can re-register after the daemon restarts.
+func (s *ServerClient) handleRegisterRSession(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		ID          string `json:"id"`
+		Address     string `json:"address"`
+		ProjectRoot string `json:"project_root"`
+		PID         int    `json:"pid"`
+		Token       string `json:"token"`
+		Origin      string `json:"origin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "invalid request body"))
+		return
+	}
+
+	if err := validateToolServerAddress(in.Address); err != nil {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, strings.Replace(err.Error(), "tool_server_address", "address", 1)))
+		return
+	}
+	if in.Origin != "" {
+		if err := validateLoopbackOrigin(in.Origin); err != nil {
+			writeError(w, r, errcode.New(errcode.InvalidRequest, err.Error()))
+			return
+		}
+	}
+	if in.ID == "" {
+		in.ID = newID()
+	} else if len(in.ID) > 128 {
+		writeError(w, r, errcode.New(errcode.InvalidRequest, "id is too long"))
+		return
+	}
+
+	session := s.rSessions.Register(rSession{
+		ID:          in.ID,
+		Address:     in.Address,
+		ProjectRoot: in.ProjectRoot,
+		PID:         in.PID,
+		Origin:      in.Origin,
+		token:       in.Token,
+	})
+	if session.RegisteredAt.Equal(session.LastSeenAt) {
+		// Only a new session counts as activity; the addin re-registers periodically
+		s.activity.touch()
+		ctxLog(r.Context()).Info().Str("r_session_id", session.ID).Str("address", session.Address).Int("pid", session.PID).Msg("R session registered")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(session)
+}
+
+// handleListRSessions lists the registered R sessions
+func (s *ServerClient) handleListRSessions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"sessions": s.rSessions.List()})
+}
+
+// handleDeleteRSession deregisters an R session
+func (s *ServerClient) handleDeleteRSession(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if !s.rSessions.Remove(id) {
+		writeError(w, r, errcode.New(errcode.NotFound, "no R session is registered as "+id))
+		return
+	}
+	ctxLog(r.Context()).Info().Str("r_session_id", id).Msg("R session deregistered")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"success": true})
+}
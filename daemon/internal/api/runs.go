@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// runCheckpointTimeout is how long runs still going at the shutdown deadline get to stop
+// once their model turns are interrupted, e.g. to finish a tool call in progress
+const runCheckpointTimeout = 5 * time.Second
+
+// errShuttingDown is the cancellation cause of model turns interrupted by a shutdown
+var errShuttingDown = errors.New("daemon is shutting down")
+
+// runTracker tracks the chat runs in progress so that shutdown can refuse new runs and
+// wait for the active ones
+type runTracker struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+	// cancels interrupts each active run's model turns, by run ID
+	cancels map[string]context.CancelCauseFunc
+}
+
+func newRunTracker() *runTracker {
+	return &runTracker{cancels: map[string]context.CancelCauseFunc{}}
+}
+
+// start registers a run, returning the context for its model turns, which is canceled if
+// the run outlives the shutdown deadline, and a function to call when the run ends. It
+// returns false once shutdown has begun.
+func (t *runTracker) start(ctx context.Context, runID string) (context.Context, func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	t.cancels[runID] = cancel
+	t.wg.Add(1)
+
+	return ctx, func() {
+		t.mu.Lock()
+		delete(t.cancels, runID)
+		t.mu.Unlock()
+		cancel(nil)
+		t.wg.Done()
+	}, true
+}
+
+// count returns the number of runs in progress
+func (t *runTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.cancels)
+}
+
+// isDraining reports whether shutdown has begun
+func (t *runTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// drain refuses new runs and waits for the active ones until ctx is done. Runs still going
+// then have their model turns interrupted and get runCheckpointTimeout to stop.
+func (t *runTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	active := len(t.cancels)
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	if active > 0 {
+		log.Info().Int("runs", active).Msg("Waiting for active runs to finish")
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	t.mu.Lock()
+	log.Warn().Int("runs", len(t.cancels)).Msg("Interrupting runs still in progress at the shutdown deadline")
+	for _, cancel := range t.cancels {
+		cancel(errShuttingDown)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(runCheckpointTimeout):
+		return errors.New("runs did not stop after being interrupted")
+	}
+}
+
+// Shutdown stops the server from starting chat runs and waits for the active ones to
+// finish, interrupting those still running when ctx is done. Call it before shutting down
+// the HTTP server, so that interrupted runs can still tell their clients.
+func (s *ServerClient) Shutdown(ctx context.Context) error {
+	return s.runs.drain(ctx)
+}
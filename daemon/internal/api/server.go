@@ -2,32 +2,96 @@ package api
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/halliday/rishi/daemon/internal/credentials"
 )
 
+// ServerOptions configures access to the daemon's HTTP endpoints
+type ServerOptions struct {
+	// AuthToken must be presented on every request
+	AuthToken string
+	// AllowedOrigins are the browser origins allowed to call the daemon
+	AllowedOrigins []string
+	// Credentials holds provider API keys
+	Credentials credentials.Store
+	// Version is the daemon's release version, reported by GET /health
+	Version string
+}
+
 // ServerClient hosts HTTP endpoints for the Rishi backend.
-type ServerClient struct{}
+type ServerClient struct {
+	opts           ServerOptions
+	usage          *usageStore
+	instructions   *instructionWatcher
+	keyValidations *keyValidations
+	rSessions      *rSessionRegistry
+	runs           *runTracker
+	activity       *activityTracker
+	startedAt      time.Time
+}
 
-func NewServerClient() *ServerClient {
-	return &ServerClient{}
+func NewServerClient(opts ServerOptions) *ServerClient {
+	if opts.AllowedOrigins == nil {
+		opts.AllowedOrigins = DefaultAllowedOrigins
+	}
+	return &ServerClient{
+		opts:           opts,
+		usage:          newUsageStore(),
+		instructions:   newInstructionWatcher(),
+		keyValidations: newKeyValidations(),
+		rSessions:      newRSessionRegistry(),
+		runs:           newRunTracker(),
+		activity:       newActivityTracker(),
+		startedAt:      time.Now().UTC(),
+	}
 }
 
 // Routes returns the HTTP handler with all routes registered.
 func (s *ServerClient) Routes() http.Handler {
 	r := chi.NewRouter()
-	r.Use(CORS())
+	r.Use(RequestID())
+	r.Use(RequestLogger())
+	r.Use(CORS(s.opts.AllowedOrigins, s.rSessions.HasOrigin))
+	r.Use(RequireToken(s.opts.AuthToken))
+	r.Use(s.TrackActivity())
 
-	// Health check endpoint
+	// Liveness with a report of the daemon's dependencies, and readiness to run chats
 	r.Get("/health", s.handleHealth)
+	r.Get("/ready", s.handleReady)
+
+	// R sessions whose tool servers handle tool calls
+	r.Post("/r-sessions", s.handleRegisterRSession)
+	r.Get("/r-sessions", s.handleListRSessions)
+	r.Delete("/r-sessions/{id}", s.handleDeleteRSession)
+
+	// R session's safe root, proxied from the R tool server
+	r.Get("/safe_root", s.handleSafeRoot)
 
 	// Streaming chat endpoint (NDJSON)
 	r.Post("/chat", s.handleChat)
 
 	// API key management endpoints
 	r.Get("/api/key", s.handleGetAPIKey)
+	r.Get("/api/keys", s.handleListAPIKeys)
 	r.Post("/api/key", s.handleSetAPIKey)
+	r.Delete("/api/key", s.handleDeleteAPIKey)
 	r.Post("/api/key/validate", s.handleValidateAPIKey)
 
+	// Daemon settings
+	r.Get("/config", s.handleGetConfig)
+
+	// Named chat profiles
+	r.Get("/profiles", s.handleListProfiles)
+	r.Post("/profiles", s.handleSetProfile)
+	r.Delete("/profiles/{name}", s.handleDeleteProfile)
+
+	// Token usage and cost reporting
+	r.Get("/usage", s.handleGetUsage)
+
+	// Prometheus metrics
+	r.Get("/metrics", s.handleMetrics)
+
 	return r
 }
@@ -0,0 +1,511 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/rs/zerolog/log"
+)
+
+// settingsConfigKey is the config.json field holding the daemon settings
+const settingsConfigKey = "daemon"
+
+// Where a setting's value came from, in increasing order of precedence
+const (
+	settingSourceDefault = "default"
+	settingSourceFile    = "file"
+	settingSourceEnv     = "env"
+	settingSourceFlag    = "flag"
+)
+
+// Settings are the daemon's settings. Each is read from, in increasing order of precedence,
+// its default, the "daemon" object in config.json, its environment variable and its
+// command-line flag. Settings tagged reload:"restart" only take effect when the daemon
+// starts; the others are applied as soon as config.json changes.
+type Settings struct {
+	// HTTPHost is the interface to listen on; loopback keeps the daemon off the network
+	HTTPHost string `json:"http_host" envconfig:"HTTP_HOST" reload:"restart" desc:"interface to listen on"`
+	HTTPPort string `json:"http_port" envconfig:"HTTP_PORT" reload:"restart" desc:"port to listen on, or 0 to pick a free one"`
+	// AllowedOrigins are the browser origins allowed to call the daemon
+	AllowedOrigins []string `json:"allowed_origins" envconfig:"RISHI_ALLOWED_ORIGINS" reload:"restart" desc:"comma-separated browser origins allowed to call the daemon"`
+	// ShutdownTimeout is how long active runs may take to finish when the daemon is stopped
+	ShutdownTimeout Duration `json:"shutdown_timeout" envconfig:"RISHI_SHUTDOWN_TIMEOUT" desc:"how long to wait for active runs when stopping, e.g. 30s"`
+	// IdleTimeout stops the daemon after a period without requests; 0 keeps it running
+	IdleTimeout Duration `json:"idle_timeout" envconfig:"RISHI_IDLE_TIMEOUT" desc:"exit after no requests for this long, e.g. 30m, or 0 to keep running"`
+
+	// ToolServerAddress is where the R addin's tool server listens: "host:port", or
+	// "unix:/path/to/socket" for a Unix domain socket
+	ToolServerAddress string `json:"tool_server_address" envconfig:"RISHI_TOOL_SERVER_ADDRESS" desc:"R tool server address, host:port or unix:/path/to/socket"`
+	// ToolServerTimeout bounds R tool server requests; ToolTimeouts overrides it per tool name
+	ToolServerTimeout Duration            `json:"tool_server_timeout" envconfig:"RISHI_TOOL_SERVER_TIMEOUT" desc:"timeout of R tool server requests, e.g. 30s"`
+	ToolTimeouts      map[string]Duration `json:"tool_timeouts,omitempty" envconfig:"RISHI_TOOL_TIMEOUTS" desc:"per-tool timeouts, e.g. console_exec:2m,str_replace_based_edit_tool:10s"`
+	// ToolServerToken authenticates the daemon to the R tool server. Without it, the token the
+	// addin writes to the config directory is used. Like the passphrase below, it's only read
+	// from the environment.
+	ToolServerToken string `json:"-" envconfig:"RISHI_TOOL_SERVER_TOKEN"`
+
+	// DefaultMaxTokens, ThinkingBudget and Temperature apply to chats that don't set them
+	DefaultMaxTokens int     `json:"default_max_tokens" envconfig:"RISHI_DEFAULT_MAX_TOKENS" desc:"max tokens per model turn"`
+	ThinkingBudget   int     `json:"thinking_budget" envconfig:"RISHI_THINKING_BUDGET" desc:"extended thinking budget in tokens"`
+	Temperature      float64 `json:"temperature" envconfig:"RISHI_TEMPERATURE" desc:"sampling temperature"`
+	// MaxImageSize is the largest image, in bytes, accepted in a chat message
+	MaxImageSize int `json:"max_image_size" envconfig:"RISHI_MAX_IMAGE_SIZE" desc:"largest accepted image in bytes"`
+
+	// LogRedact masks API keys, tokens, connection string credentials and email addresses in logs
+	LogRedact bool `json:"log_redact" envconfig:"RISHI_LOG_REDACT" desc:"redact secrets and personal data in logs"`
+	// LogMetadataOnly logs only the sizes of tool inputs and results, never their contents
+	LogMetadataOnly bool `json:"log_metadata_only" envconfig:"RISHI_LOG_METADATA_ONLY" desc:"log only the sizes of tool inputs and results"`
+
+	// Tracing records spans for runs, model turns and tool calls
+	Tracing bool `json:"tracing" envconfig:"RISHI_TRACING" reload:"restart" desc:"record traces of runs, model turns and tool calls"`
+	// OTLPEndpoint sends spans to an OTLP HTTP collector instead of the local trace file
+	OTLPEndpoint string `json:"otlp_endpoint" envconfig:"OTEL_EXPORTER_OTLP_ENDPOINT" reload:"restart" desc:"OTLP HTTP collector to export traces to"`
+
+	// CredentialsPassphrase derives the key of the encrypted credential store; without it the
+	// key is kept in a machine-local key file. It's only read from the environment so that
+	// it's never written to disk or shown by GET /config.
+	CredentialsPassphrase string `json:"-" envconfig:"RISHI_CREDENTIALS_PASSPHRASE"`
+}
+
+// DefaultSettings returns the settings used when nothing overrides them
+func DefaultSettings() Settings {
+	return Settings{
+		HTTPHost:          "127.0.0.1",
+		HTTPPort:          "8080",
+		AllowedOrigins:    DefaultAllowedOrigins,
+		ShutdownTimeout:   Duration(30 * time.Second),
+		ToolServerAddress: "127.0.0.1:8082",
+		ToolServerTimeout: Duration(30 * time.Second),
+		DefaultMaxTokens:  8192,
+		ThinkingBudget:    4096,
+		Temperature:       0.1,
+		MaxImageSize:      5 * 1024 * 1024, // 5MB per image
+		LogRedact:         true,
+		Tracing:           true,
+	}
+}
+
+// Validate checks that every setting is usable
+func (s Settings) Validate() error {
+	var errs []error
+	if s.HTTPHost == "" {
+		errs = append(errs, errors.New("http_host must not be empty"))
+	}
+	// Port 0 asks the OS for a free port, which is published in the discovery file
+	if s.HTTPPort != "0" && !validPort(s.HTTPPort) {
+		errs = append(errs, fmt.Errorf("http_port %q is not a valid port", s.HTTPPort))
+	}
+	for _, origin := range s.AllowedOrigins {
+		if u, err := url.Parse(origin); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			errs = append(errs, fmt.Errorf("allowed origin %q must be an http or https origin", origin))
+		}
+	}
+	if s.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdown_timeout must not be negative"))
+	}
+	if s.IdleTimeout < 0 {
+		errs = append(errs, errors.New("idle_timeout must not be negative"))
+	}
+	if err := validateToolServerAddress(s.ToolServerAddress); err != nil {
+		errs = append(errs, err)
+	}
+	if s.ToolServerTimeout <= 0 {
+		errs = append(errs, errors.New("tool_server_timeout must be positive"))
+	}
+	for tool, timeout := range s.ToolTimeouts {
+		if !slices.Contains(toolNames, tool) {
+			errs = append(errs, fmt.Errorf("tool_timeouts: unknown tool %q, expected one of %s", tool, strings.Join(toolNames, ", ")))
+		} else if timeout <= 0 {
+			errs = append(errs, fmt.Errorf("tool_timeouts: timeout of %s must be positive", tool))
+		}
+	}
+	if s.DefaultMaxTokens <= 0 {
+		errs = append(errs, errors.New("default_max_tokens must be positive"))
+	}
+	if s.ThinkingBudget < minThinkingBudget {
+		errs = append(errs, fmt.Errorf("thinking_budget must be at least %d", minThinkingBudget))
+	}
+	if s.Temperature < 0 || s.Temperature > 1 {
+		errs = append(errs, errors.New("temperature must be between 0 and 1"))
+	}
+	if s.MaxImageSize <= 0 {
+		errs = append(errs, errors.New("max_image_size must be positive"))
+	}
+	if s.OTLPEndpoint != "" {
+		if u, err := url.Parse(s.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("otlp_endpoint must be an http or https URL"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateToolServerAddress checks a "host:port" or "unix:/path" address
+func validateToolServerAddress(address string) error {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		if path == "" {
+			return errors.New("tool_server_address has an empty socket path")
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || !validPort(port) {
+		return fmt.Errorf("tool_server_address %q must be host:port or unix:/path/to/socket", address)
+	}
+	return nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// Duration is a time.Duration written as a string such as "30s" in config files,
+// environment variables and flags
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// SettingsFlags holds the command-line flags overriding settings
+type SettingsFlags struct {
+	fs     *flag.FlagSet
+	values Settings
+}
+
+// RegisterSettingsFlags registers a flag for each setting that can be set in config.json,
+// named after its JSON field with dashes, e.g. -http-port
+func RegisterSettingsFlags(fs *flag.FlagSet) *SettingsFlags {
+	flags := &SettingsFlags{fs: fs, values: DefaultSettings()}
+	v := reflect.ValueOf(&flags.values).Elem()
+	for i, field := range reflect.VisibleFields(v.Type()) {
+		name, ok := settingName(field)
+		if !ok {
+			continue
+		}
+		name = strings.ReplaceAll(name, "_", "-")
+		usage := field.Tag.Get("desc")
+		switch p := v.Field(i).Addr().Interface().(type) {
+		case *string:
+			fs.StringVar(p, name, *p, usage)
+		case *int:
+			fs.IntVar(p, name, *p, usage)
+		case *float64:
+			fs.Float64Var(p, name, *p, usage)
+		case *bool:
+			fs.BoolVar(p, name, *p, usage)
+		case *Duration:
+			fs.TextVar(p, name, *p, usage)
+		case *[]string:
+			fs.Func(name, usage, func(s string) error {
+				*p = strings.Split(s, ",")
+				return nil
+			})
+		case *map[string]Duration:
+			// Same name:value,name:value format as the environment variable
+			fs.Func(name, usage, func(s string) error {
+				m := map[string]Duration{}
+				for _, pair := range strings.Split(s, ",") {
+					key, value, ok := strings.Cut(pair, ":")
+					if !ok {
+						return fmt.Errorf("invalid entry %q, expected name:duration", pair)
+					}
+					var d Duration
+					if err := d.UnmarshalText([]byte(value)); err != nil {
+						return err
+					}
+					m[key] = d
+				}
+				*p = m
+				return nil
+			})
+		default:
+			panic("unsupported setting type " + field.Type.String())
+		}
+	}
+	return flags
+}
+
+// SettingsSnapshot is a loaded set of settings along with where each came from
+type SettingsSnapshot struct {
+	Settings Settings          `json:"settings"`
+	Sources  map[string]string `json:"sources"`
+	Path     string            `json:"path"`
+	LoadedAt time.Time         `json:"loaded_at"`
+
+	// Profiles and DefaultProfile are the chat profiles from config.json, reloaded along with
+	// the settings so chats don't read the file. GET /profiles lists them.
+	Profiles       map[string]Profile `json:"-"`
+	DefaultProfile string             `json:"-"`
+}
+
+// LoadSettings layers the defaults, config.json, the environment and flags, which may be
+// nil, and validates the result
+func LoadSettings(flags *SettingsFlags) (*SettingsSnapshot, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &SettingsSnapshot{
+		Settings: DefaultSettings(),
+		Sources:  map[string]string{},
+		Path:     configPath,
+		LoadedAt: time.Now().UTC(),
+	}
+	fields := reflect.VisibleFields(reflect.TypeOf(Settings{}))
+	for _, field := range fields {
+		if name, ok := settingName(field); ok {
+			snapshot.Sources[name] = settingSourceDefault
+		}
+	}
+
+	// config.json
+	configFields, _, err := readConfigFields(configPath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := decodeConfig(configFields)
+	if err != nil {
+		return nil, fmt.Errorf("invalid profiles in %s: %w", configPath, err)
+	}
+	snapshot.Profiles, snapshot.DefaultProfile = config.Profiles, config.DefaultProfile
+	if fileSettings := configFields[settingsConfigKey]; fileSettings != nil {
+		names, err := decodeFileSettings(fileSettings, &snapshot.Settings)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %q settings in %s: %w", settingsConfigKey, configPath, err)
+		}
+		for _, name := range names {
+			snapshot.Sources[name] = settingSourceFile
+		}
+	}
+
+	// Environment; fields whose variable is unset are left alone
+	if err := envconfig.Process("", &snapshot.Settings); err != nil {
+		return nil, fmt.Errorf("invalid environment configuration: %w", err)
+	}
+	for _, field := range fields {
+		name, ok := settingName(field)
+		if _, set := os.LookupEnv(field.Tag.Get("envconfig")); ok && set {
+			snapshot.Sources[name] = settingSourceEnv
+		}
+	}
+
+	// Flags
+	if flags != nil {
+		dst := reflect.ValueOf(&snapshot.Settings).Elem()
+		src := reflect.ValueOf(flags.values)
+		flags.fs.Visit(func(f *flag.Flag) {
+			for i, field := range fields {
+				if name, ok := settingName(field); ok && strings.ReplaceAll(name, "_", "-") == f.Name {
+					dst.Field(i).Set(src.Field(i))
+					snapshot.Sources[name] = settingSourceFlag
+				}
+			}
+		})
+	}
+
+	if err := snapshot.Settings.Validate(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// settingName returns the JSON name of a setting, and false for settings that can only be
+// set by environment variable
+func settingName(field reflect.StructField) (string, bool) {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return name, name != "" && name != "-"
+}
+
+// decodeFileSettings decodes the settings object from config.json over s and returns the
+// names of the settings it sets. Each unknown setting or invalid value is reported with
+// the setting's name.
+func decodeFileSettings(raw json.RawMessage, s *Settings) ([]string, error) {
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &present); err != nil {
+		return nil, errors.New("settings must be a JSON object")
+	}
+
+	dst := reflect.ValueOf(s).Elem()
+	fields := map[string]int{}
+	for i, field := range reflect.VisibleFields(dst.Type()) {
+		if name, ok := settingName(field); ok {
+			fields[name] = i
+		}
+	}
+
+	names := slices.Sorted(maps.Keys(present))
+
+	var errs []error
+	for _, name := range names {
+		i, ok := fields[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown setting %q", name))
+			continue
+		}
+		if err := json.Unmarshal(present[name], dst.Field(i).Addr().Interface()); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return names, nil
+}
+
+// diffSettings returns the names of the settings that differ between the current and the
+// reloaded snapshot. Settings that need a restart keep their current value and source in
+// reloaded, and are returned separately.
+func diffSettings(current, reloaded *SettingsSnapshot) (changed, pending []string) {
+	vc, vr := reflect.ValueOf(&current.Settings).Elem(), reflect.ValueOf(&reloaded.Settings).Elem()
+	for i, field := range reflect.VisibleFields(vc.Type()) {
+		name, ok := settingName(field)
+		if !ok || reflect.DeepEqual(vc.Field(i).Interface(), vr.Field(i).Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") == "restart" {
+			vr.Field(i).Set(vc.Field(i))
+			reloaded.Sources[name] = current.Sources[name]
+			pending = append(pending, name)
+			continue
+		}
+		changed = append(changed, name)
+	}
+	return changed, pending
+}
+
+// settings holds the daemon's current settings
+var settings atomic.Pointer[SettingsSnapshot]
+
+// SetSettings replaces the daemon's current settings
+func SetSettings(snapshot *SettingsSnapshot) {
+	settings.Store(snapshot)
+}
+
+// currentProfiles returns the current chat profiles and the default profile's name
+func currentProfiles() (map[string]Profile, string) {
+	if snapshot := settings.Load(); snapshot != nil {
+		return snapshot.Profiles, snapshot.DefaultProfile
+	}
+	return nil, ""
+}
+
+// storeProfiles makes profiles just written to config.json current, rather than waiting for
+// WatchSettings to notice the change
+func storeProfiles(config *Config) {
+	current := settings.Load()
+	if current == nil {
+		return
+	}
+	next := *current
+	next.Profiles, next.DefaultProfile = config.Profiles, config.DefaultProfile
+	settings.Store(&next)
+}
+
+// currentSettings returns the daemon's current settings, or the defaults if none are set
+func currentSettings() Settings {
+	if snapshot := settings.Load(); snapshot != nil {
+		return snapshot.Settings
+	}
+	return DefaultSettings()
+}
+
+// WatchSettings polls config.json every interval until ctx is done, and calls apply with
+// the reloaded settings whenever they change. A file with invalid settings is logged and
+// ignored, keeping the current settings.
+func WatchSettings(ctx context.Context, flags *SettingsFlags, interval time.Duration, apply func(*SettingsSnapshot)) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		log.Error().Err(err).Msg("Not watching config file for changes")
+		return
+	}
+
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(configPath)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	lastMod, lastSize := stat()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		mod, size := stat()
+		if mod.Equal(lastMod) && size == lastSize {
+			continue
+		}
+		lastMod, lastSize = mod, size
+
+		snapshot, err := LoadSettings(flags)
+		if err != nil {
+			log.Error().Err(err).Msg("Ignoring invalid settings in config file")
+			continue
+		}
+		current := settings.Load()
+		if current == nil {
+			continue
+		}
+		changed, pending := diffSettings(current, snapshot)
+		if len(pending) > 0 {
+			log.Warn().Strs("settings", pending).Msg("Changed settings take effect only after the daemon restarts")
+		}
+		profilesChanged := !reflect.DeepEqual(current.Profiles, snapshot.Profiles) || current.DefaultProfile != snapshot.DefaultProfile
+		if len(changed) == 0 && !profilesChanged {
+			continue
+		}
+		if len(changed) > 0 {
+			log.Info().Strs("settings", changed).Msg("Reloaded settings")
+		}
+		if profilesChanged {
+			log.Info().Msg("Reloaded profiles")
+		}
+		apply(snapshot)
+	}
+}
+
+// handleGetConfig returns the daemon's current settings and where each came from
+func (s *ServerClient) handleGetConfig(w http.ResponseWriter, r *http.Request) {
+	snapshot := settings.Load()
+	if snapshot == nil {
+		writeError(w, r, errcode.New(errcode.ConfigError, "settings are not loaded"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(snapshot)
+}
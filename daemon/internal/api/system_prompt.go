@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+const (
+	// sessionInfoTimeout bounds how long a chat waits on the R tool server for session details
+	sessionInfoTimeout = 2 * time.Second
+
+	// maxPromptPackages caps how many loaded packages are listed in the system prompt
+	maxPromptPackages = 50
+)
+
+// sessionInfo describes the user's R session, as reported by the R tool server
+type sessionInfo struct {
+	Project        string   `json:"project"`
+	RVersion       string   `json:"r_version"`
+	LoadedPackages []string `json:"loaded_packages"`
+	SafeRoot       string   `json:"safe_root"`
+	ActiveDocument string   `json:"active_document"`
+}
+
+// fetchSessionInfo asks the R tool server for the current session details
+func fetchSessionInfo(ctx context.Context) (sessionInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, sessionInfoTimeout)
+	defer cancel()
+
+	var info sessionInfo
+	if err := fetchToolResource(ctx, "/session_info", &info); err != nil {
+		return sessionInfo{}, err
+	}
+	return info, nil
+}
+
+// promptSection is a dynamic part of the system prompt, rendered as <name>body</name>
+type promptSection struct {
+	Name string
+	Body string
+}
+
+// systemPromptBuilder composes the static base prompt with dynamic sections that
+// describe the user's current R session.
+type systemPromptBuilder struct {
+	base     string
+	sections []promptSection
+}
+
+func newSystemPromptBuilder(base string) *systemPromptBuilder {
+	return &systemPromptBuilder{base: base}
+}
+
+// AddSection appends a dynamic section; sections with an empty body are skipped
+func (b *systemPromptBuilder) AddSection(name, body string) *systemPromptBuilder {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return b
+	}
+	b.sections = append(b.sections, promptSection{Name: name, Body: body})
+	return b
+}
+
+// AddSessionInfo adds sections for the active project, R version, safe root,
+// open editor file and loaded packages.
+func (b *systemPromptBuilder) AddSessionInfo(info sessionInfo) *systemPromptBuilder {
+	b.AddSection("active_project", info.Project)
+	b.AddSection("r_version", info.RVersion)
+	if info.SafeRoot != "" {
+		b.AddSection("safe_root", fmt.Sprintf("%s\nAll file paths passed to tools are relative to this directory.", info.SafeRoot))
+	}
+	b.AddSection("open_editor_file", info.ActiveDocument)
+
+	packages := info.LoadedPackages
+	if len(packages) > maxPromptPackages {
+		packages = append(packages[:maxPromptPackages:maxPromptPackages], fmt.Sprintf("... and %d more", len(info.LoadedPackages)-maxPromptPackages))
+	}
+	b.AddSection("loaded_packages", strings.Join(packages, ", "))
+
+	return b
+}
+
+// AddInstructions adds sections for RISHI.md instruction files. Files are expected in
+// increasing order of precedence, and the model is told that later scopes win.
+func (b *systemPromptBuilder) AddInstructions(files []instructionFile) *systemPromptBuilder {
+	for _, file := range files {
+		body := fmt.Sprintf("The USER's %s-level instructions from %s. Follow them unless the USER asks otherwise.", file.Scope, file.Path)
+		if file.Scope == instructionScopeProject {
+			body += " Where they conflict with user-level instructions, these project instructions take precedence."
+		}
+		b.AddSection(file.Scope+"_instructions", body+"\n\n"+file.content)
+	}
+	return b
+}
+
+// Build returns the system prompt as text blocks for the native system parameter.
+// The base prompt and the dynamic sections are separate blocks, each with a cache
+// breakpoint, so the base prompt stays cached when the session details change.
+func (b *systemPromptBuilder) Build() []anthropic.TextBlockParam {
+	blocks := []anthropic.TextBlockParam{
+		{Text: b.base, CacheControl: anthropic.NewCacheControlEphemeralParam()},
+	}
+
+	if len(b.sections) == 0 {
+		return blocks
+	}
+
+	var sb strings.Builder
+	sb.WriteString("The following describes the USER's current R session and any instructions they have configured.\n")
+	for _, section := range b.sections {
+		fmt.Fprintf(&sb, "\n<%s>\n%s\n</%s>\n", section.Name, section.Body, section.Name)
+	}
+
+	return append(blocks, anthropic.TextBlockParam{
+		Text:         sb.String(),
+		CacheControl: anthropic.NewCacheControlEphemeralParam(),
+	})
+}
+
+// buildSystemPrompt assembles the system prompt for a chat request and returns the
+// instruction files it applied. fallbackSafeRoot is the safe root reported by the
+// frontend, used when the R tool server can't be reached.
+func (s *ServerClient) buildSystemPrompt(ctx context.Context, fallbackSafeRoot string) ([]anthropic.TextBlockParam, []instructionFile) {
+	builder := newSystemPromptBuilder(RISHI_SYSTEM_PROMPT)
+
+	info, err := fetchSessionInfo(ctx)
+	if err != nil {
+		ctxLog(ctx).Warn().Err(err).Msg("Failed to fetch R session info, system prompt will omit session details")
+	}
+	if info.SafeRoot == "" {
+		info.SafeRoot = fallbackSafeRoot
+	}
+
+	// Instruction files live at the project root, falling back to the safe root
+	projectRoot := info.Project
+	if projectRoot == "" {
+		projectRoot = info.SafeRoot
+	}
+	instructions := s.instructions.Resolve(projectRoot)
+
+	return builder.AddSessionInfo(info).AddInstructions(instructions).Build(), instructions
+}
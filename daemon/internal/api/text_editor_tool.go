@@ -2,19 +2,15 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
 
-	"github.com/rs/zerolog/log"
-)
-
-const (
-	// R tool server configuration
-	rToolServerPort    = "8082"
-	rToolServerTimeout = 30 * time.Second
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/halliday/rishi/daemon/internal/tracing"
 )
 
 // TextEditorCommand represents the available commands for the text editor tool
@@ -60,8 +56,9 @@ type textEditorViewInput struct {
 }
 
 type textEditorViewOutput struct {
-	Content string `json:"content"`
-	Error   string `json:"error"`
+	Content   string       `json:"content"`
+	Error     string       `json:"error"`
+	ErrorCode errcode.Code `json:"error_code,omitempty"`
 }
 
 type textEditorStrReplaceInput struct {
@@ -71,8 +68,9 @@ type textEditorStrReplaceInput struct {
 }
 
 type textEditorStrReplaceOutput struct {
-	Content string `json:"content"`
-	Error   string `json:"error"`
+	Content   string       `json:"content"`
+	Error     string       `json:"error"`
+	ErrorCode errcode.Code `json:"error_code,omitempty"`
 }
 
 type textEditorCreateInput struct {
@@ -81,8 +79,9 @@ type textEditorCreateInput struct {
 }
 
 type textEditorCreateOutput struct {
-	Content string `json:"content"`
-	Error   string `json:"error"`
+	Content   string       `json:"content"`
+	Error     string       `json:"error"`
+	ErrorCode errcode.Code `json:"error_code,omitempty"`
 }
 
 type textEditorInsertInput struct {
@@ -92,101 +91,175 @@ type textEditorInsertInput struct {
 }
 
 type textEditorInsertOutput struct {
-	Content string `json:"content"`
-	Error   string `json:"error"`
-}
-
-// HTTP client for R tool server
-var toolClient = &http.Client{
-	Timeout: rToolServerTimeout,
+	Content   string       `json:"content"`
+	Error     string       `json:"error"`
+	ErrorCode errcode.Code `json:"error_code,omitempty"`
 }
 
 // makeToolRequest makes an HTTP POST request to the R tool server
-func makeToolRequest(endpoint string, payload interface{}, response interface{}) error {
+func makeToolRequest(ctx context.Context, endpoint string, payload interface{}, response interface{}) error {
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://127.0.0.1:%s%s", rToolServerPort, endpoint), bytes.NewBuffer(jsonData))
+	server := toolServerFromContext(ctx)
+	client, baseURL := server.client()
+	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := toolClient.Do(req)
+	return doToolRequest(client, server, req, response)
+}
+
+// fetchToolResource makes an HTTP GET request to the R tool server
+func fetchToolResource(ctx context.Context, endpoint string, response interface{}) error {
+	server := toolServerFromContext(ctx)
+	client, baseURL := server.client()
+	req, err := http.NewRequestWithContext(ctx, "GET", baseURL+endpoint, nil)
 	if err != nil {
-		return fmt.Errorf("HTTP request failed: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	return doToolRequest(client, server, req, response)
+}
+
+// doToolRequest sends a request to the R tool server and decodes its JSON response.
+// Request, run and tool use IDs and the trace context are forwarded as headers so that
+// R-side logs can be correlated with the daemon's. Requests made outside a tool call,
+// which sets its own deadline, are bounded by tool_server_timeout.
+func doToolRequest(client *http.Client, server toolServer, req *http.Request, response interface{}) error {
+	ctx := req.Context()
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(currentSettings().ToolServerTimeout))
+		defer cancel()
+	}
+	ctx, span := tracing.Start(ctx, "r_tool_server.request", tracing.SpanKindClient,
+		tracing.String("http.request.method", req.Method),
+		tracing.String("rishi.r.endpoint", req.URL.Path),
+		tracing.String("rishi.r.address", server.Address),
+	)
+	defer span.End()
+	req = req.WithContext(ctx)
+	if server.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+server.Token)
+	}
+	if traceParent := span.TraceParent(); traceParent != "" {
+		req.Header.Set("traceparent", traceParent)
+	}
+	if id := requestIDFromContext(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if id := runIDFromContext(ctx); id != "" {
+		req.Header.Set("X-Rishi-Run-ID", id)
+	}
+	if id := toolUseIDFromContext(ctx); id != "" {
+		req.Header.Set("X-Rishi-Tool-Use-ID", id)
+	}
+
+	start := time.Now()
+	defer func() {
+		rToolServerRequestDuration.ObserveDuration(time.Since(start), req.URL.Path)
+		ctxLog(ctx).Debug().Str("endpoint", req.URL.Path).Dur("duration", time.Since(start)).Msg("R tool server request")
+	}()
+
+	endRequest := server.beginRequest()
+	status, err := sendToolRequest(client, req, response)
+	endRequest(status != 0)
+	if status != 0 {
+		span.SetAttributes(tracing.Int("http.response.status_code", status))
+	}
+	if err != nil {
+		rToolServerErrorsTotal.Inc(req.URL.Path)
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// sendToolRequest sends a prepared request to the R tool server and decodes its JSON response.
+// It returns the response status code, or 0 if no response was received.
+func sendToolRequest(client *http.Client, req *http.Request, response interface{}) (int, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("HTTP request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+		return resp.StatusCode, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+		return resp.StatusCode, &toolServerStatusError{StatusCode: resp.StatusCode, Body: body}
 	}
 
 	if err := json.Unmarshal(body, response); err != nil {
-		return fmt.Errorf("failed to parse response: %w", err)
+		return resp.StatusCode, fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	return nil
+	return resp.StatusCode, nil
 }
 
-func textEditorView(input textEditorViewInput) textEditorViewOutput {
+func textEditorView(ctx context.Context, input textEditorViewInput) textEditorViewOutput {
 	var output textEditorViewOutput
 
-	err := makeToolRequest("/text_editor/view", input, &output)
+	err := makeToolRequest(ctx, "/text_editor/view", input, &output)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to call text editor view endpoint")
+		ctxLog(ctx).Error().Err(err).Str("endpoint", "/text_editor/view").Msg("Failed to call R tool server")
 		return textEditorViewOutput{
-			Error: fmt.Sprintf("Failed to communicate with R server: %v", err),
+			Error:     fmt.Sprintf("Failed to communicate with R server: %v", err),
+			ErrorCode: errcode.ToolServerUnavailable,
 		}
 	}
 
 	return output
 }
 
-func textEditorStrReplace(input textEditorStrReplaceInput) textEditorStrReplaceOutput {
+func textEditorStrReplace(ctx context.Context, input textEditorStrReplaceInput) textEditorStrReplaceOutput {
 	var output textEditorStrReplaceOutput
 
-	err := makeToolRequest("/text_editor/str_replace", input, &output)
+	err := makeToolRequest(ctx, "/text_editor/str_replace", input, &output)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to call text editor str_replace endpoint")
+		ctxLog(ctx).Error().Err(err).Str("endpoint", "/text_editor/str_replace").Msg("Failed to call R tool server")
 		return textEditorStrReplaceOutput{
-			Error: fmt.Sprintf("Failed to communicate with R server: %v", err),
+			Error:     fmt.Sprintf("Failed to communicate with R server: %v", err),
+			ErrorCode: errcode.ToolServerUnavailable,
 		}
 	}
 
 	return output
 }
 
-func textEditorCreate(input textEditorCreateInput) textEditorCreateOutput {
+func textEditorCreate(ctx context.Context, input textEditorCreateInput) textEditorCreateOutput {
 	var output textEditorCreateOutput
 
-	err := makeToolRequest("/text_editor/create", input, &output)
+	err := makeToolRequest(ctx, "/text_editor/create", input, &output)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to call text editor create endpoint")
+		ctxLog(ctx).Error().Err(err).Str("endpoint", "/text_editor/create").Msg("Failed to call R tool server")
 		return textEditorCreateOutput{
-			Error: fmt.Sprintf("Failed to communicate with R server: %v", err),
+			Error:     fmt.Sprintf("Failed to communicate with R server: %v", err),
+			ErrorCode: errcode.ToolServerUnavailable,
 		}
 	}
 
 	return output
 }
 
-func textEditorInsert(input textEditorInsertInput) textEditorInsertOutput {
+func textEditorInsert(ctx context.Context, input textEditorInsertInput) textEditorInsertOutput {
 	var output textEditorInsertOutput
 
-	err := makeToolRequest("/text_editor/insert", input, &output)
+	err := makeToolRequest(ctx, "/text_editor/insert", input, &output)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to call text editor insert endpoint")
+		ctxLog(ctx).Error().Err(err).Str("endpoint", "/text_editor/insert").Msg("Failed to call R tool server")
 		return textEditorInsertOutput{
-			Error: fmt.Sprintf("Failed to communicate with R server: %v", err),
+			Error:     fmt.Sprintf("Failed to communicate with R server: %v", err),
+			ErrorCode: errcode.ToolServerUnavailable,
 		}
 	}
 
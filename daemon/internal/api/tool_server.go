@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolServerTokenFile returns the file in the config directory where the R addin writes the
+// token expected by the tool server at address. Each address has its own file so that R
+// sessions don't overwrite each other's tokens.
+func toolServerTokenFile(configDir, address string) string {
+	key := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, address)
+	return filepath.Join(configDir, "tool_server."+key+".token")
+}
+
+// toolServer is an R tool server the daemon sends tool calls to
+type toolServer struct {
+	// Address is "host:port", or "unix:/path/to/socket" for a Unix domain socket
+	Address string
+	// Token is sent as a bearer token, if set
+	Token string
+
+	// rSessions and rSessionID identify the registered R session serving the tool server, so
+	// its health checks make allowance for requests underway. Unset for the tool server
+	// from the settings.
+	rSessions  *rSessionRegistry
+	rSessionID string
+}
+
+// beginRequest marks a request to the tool server as underway, returning the func that ends it
+func (t toolServer) beginRequest() func(responded bool) {
+	if t.rSessions == nil {
+		return func(bool) {}
+	}
+	t.rSessions.beginRequest(t.rSessionID)
+	return func(responded bool) { t.rSessions.endRequest(t.rSessionID, responded) }
+}
+
+// currentToolServer returns the tool server configured in the settings, authenticated with
+// the configured token or the one the addin wrote to the config directory
+func currentToolServer() toolServer {
+	settings := currentSettings()
+	server := toolServer{Address: settings.ToolServerAddress, Token: settings.ToolServerToken}
+	if server.Token == "" {
+		server.Token = readToolServerToken(server.Address)
+	}
+	return server
+}
+
+// readToolServerToken returns the token the addin wrote for the tool server at address, or
+// "" if there is none
+func readToolServerToken(address string) string {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(toolServerTokenFile(configDir, address))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// toolClients caches an HTTP client per tool server address so connections are reused
+var toolClients sync.Map
+
+// client returns the HTTP client and base URL for the tool server's address
+func (t toolServer) client() (*http.Client, string) {
+	socketPath, isUnix := strings.CutPrefix(t.Address, "unix:")
+	baseURL := "http://" + t.Address
+	if isUnix {
+		// The host is ignored when dialing a socket, but requests need one
+		baseURL = "http://r-tool-server"
+	}
+
+	if client, ok := toolClients.Load(t.Address); ok {
+		return client.(*http.Client), baseURL
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if isUnix {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+	client, _ := toolClients.LoadOrStore(t.Address, &http.Client{Transport: transport})
+	return client.(*http.Client), baseURL
+}
+
+// PingToolServer checks that the R tool server from the settings answers its health check
+func PingToolServer(ctx context.Context) error {
+	return pingToolServer(ctx, currentToolServer())
+}
+
+// toolNames are the tools the model can call on the R tool server
+var toolNames = []string{"console_exec", "str_replace_based_edit_tool"}
+
+// toolTimeout returns how long a call to the named tool may take
+func toolTimeout(name string) time.Duration {
+	settings := currentSettings()
+	if timeout, ok := settings.ToolTimeouts[name]; ok {
+		return time.Duration(timeout)
+	}
+	return time.Duration(settings.ToolServerTimeout)
+}
+
+// toolServerStatusError is returned when the R tool server responds with an error status
+type toolServerStatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *toolServerStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
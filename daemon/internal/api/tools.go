@@ -0,0 +1,196 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/halliday/rishi/daemon/internal/logging"
+	"github.com/halliday/rishi/daemon/internal/tracing"
+)
+
+// toolErrorOutput is the result sent back for a tool call the daemon couldn't dispatch
+type toolErrorOutput struct {
+	Error     string       `json:"error"`
+	ErrorCode errcode.Code `json:"error_code"`
+}
+
+// executeToolUse runs a tool call requested by the model, streaming its start and completion
+// events to the frontend, and returns the JSON-encoded result to send back to the model.
+func executeToolUse(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, block anthropic.ToolUseBlock) (string, bool, error) {
+	ctx = withToolUse(ctx, block.ID, block.Name)
+	ctx, cancel := context.WithTimeout(ctx, toolTimeout(block.Name))
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "tool.execute", tracing.SpanKindInternal,
+		tracing.String("rishi.tool.name", block.Name),
+		tracing.String("rishi.tool.use_id", block.ID),
+	)
+	defer span.End()
+	logger := ctxLog(ctx)
+	logger.Info().Func(logging.Content("input", block.JSON.Input.Raw())).Msg("tool use")
+	start := time.Now()
+
+	var response interface{}
+	switch block.Name {
+	case "console_exec":
+		var input consoleExecInput
+		if err := json.Unmarshal([]byte(block.JSON.Input.Raw()), &input); err != nil {
+			errMsg := fmt.Sprintf("Failed to parse console exec input: %s, error: %v", block.JSON.Input.Raw(), err)
+			logger.Error().Err(err).Msg("Failed to parse console exec input")
+			response = consoleExecOutput{
+				Error:     errMsg,
+				ErrorCode: errcode.ToolInvalidInput,
+			}
+			break
+		}
+
+		streamToolCallStart(w, flusher, block.ID, "console_exec", input)
+		response = consoleExec(ctx, input)
+
+	case "str_replace_based_edit_tool":
+		var input textEditorInput
+		if err := json.Unmarshal([]byte(block.JSON.Input.Raw()), &input); err != nil {
+			errMsg := fmt.Sprintf("Failed to parse text editor input: %s, error: %v", block.JSON.Input.Raw(), err)
+			logger.Error().Err(err).Msg("Failed to parse text editor input")
+			response = textEditorViewOutput{
+				Error:     errMsg,
+				ErrorCode: errcode.ToolInvalidInput,
+			}
+			break
+		}
+
+		// Validate required fields
+		if input.Command == "" {
+			errMsg := "Error: Missing required 'command' field. The text editor tool requires a 'command' parameter. Available commands: 'view' (to read files/directories). Example: {\"command\": \"view\", \"path\": \"filename.txt\"}"
+			logger.Error().Msg("Text editor input is missing the command field")
+			response = textEditorViewOutput{
+				Error:     errMsg,
+				ErrorCode: errcode.ToolInvalidInput,
+			}
+			break
+		}
+
+		switch input.Command {
+		case ViewCommand:
+			viewInput := textEditorViewInput{
+				Path:      input.Path,
+				ViewRange: input.ViewRange,
+			}
+			streamToolCallStart(w, flusher, block.ID, string(input.Command), viewInput)
+			response = textEditorView(ctx, viewInput)
+		case StrReplaceCommand:
+			strReplaceInput := textEditorStrReplaceInput{
+				Path:   input.Path,
+				OldStr: input.OldStr,
+				NewStr: input.NewStr,
+			}
+			streamToolCallStart(w, flusher, block.ID, string(input.Command), strReplaceInput)
+			response = textEditorStrReplace(ctx, strReplaceInput)
+		case CreateCommand:
+			createInput := textEditorCreateInput{
+				Path:     input.Path,
+				FileText: input.FileText,
+			}
+			streamToolCallStart(w, flusher, block.ID, string(input.Command), createInput)
+			response = textEditorCreate(ctx, createInput)
+		case InsertCommand:
+			// Handle both field names - docs say new_str but API sends insert_text
+			insertText := input.NewStr
+			if insertText == "" {
+				insertText = input.InsertText
+			}
+			insertInput := textEditorInsertInput{
+				Path:       input.Path,
+				InsertLine: input.InsertLine,
+				NewStr:     insertText,
+			}
+			streamToolCallStart(w, flusher, block.ID, string(input.Command), insertInput)
+			response = textEditorInsert(ctx, insertInput)
+		default:
+			errMsg := fmt.Sprintf("Error: Unsupported text editor command '%s'. Available commands: 'view', 'str_replace', 'create', 'insert'.", input.Command)
+			logger.Error().Str("command", string(input.Command)).Msg("Unsupported text editor command")
+			response = textEditorViewOutput{
+				Error:     errMsg,
+				ErrorCode: errcode.ToolInvalidInput,
+			}
+		}
+
+	default:
+		errMsg := fmt.Sprintf("Error: Unknown tool '%s'.", block.Name)
+		logger.Error().Msg("Unknown tool")
+		response = toolErrorOutput{
+			Error:     errMsg,
+			ErrorCode: errcode.ToolUnknown,
+		}
+	}
+
+	b, err := json.Marshal(response)
+	if err != nil {
+		return "", false, fmt.Errorf("error parsing tool result: %w", err)
+	}
+
+	logger.Info().
+		Int("result_bytes", len(b)).
+		Func(logging.Preview("result_preview", string(b), 100)).
+		Dur("duration", time.Since(start)).
+		Msg("tool call completed")
+
+	var isError bool
+	// toolName labels the call's metrics; text editor calls are labeled by command
+	toolName := "unknown"
+
+	// Stream tool call completion event to frontend
+	switch block.Name {
+	case "console_exec":
+		var input consoleExecInput
+		if err := json.Unmarshal([]byte(block.JSON.Input.Raw()), &input); err != nil {
+			logger.Error().Err(err).Msg("Failed to parse console exec input for completion event")
+		}
+
+		toolName = "console_exec"
+		isError = streamToolCallComplete(w, flusher, block.ID, "console_exec", input, response)
+	case "str_replace_based_edit_tool":
+		var input textEditorInput
+		if err := json.Unmarshal([]byte(block.JSON.Input.Raw()), &input); err != nil {
+			logger.Error().Err(err).Msg("Failed to parse text editor input for completion event")
+		}
+
+		var commandName string
+		switch response.(type) {
+		case textEditorViewOutput:
+			commandName = string(ViewCommand)
+		case textEditorStrReplaceOutput:
+			commandName = string(StrReplaceCommand)
+		case textEditorCreateOutput:
+			commandName = string(CreateCommand)
+		case textEditorInsertOutput:
+			commandName = string(InsertCommand)
+		}
+
+		toolName = commandName
+		isError = streamToolCallComplete(w, flusher, block.ID, commandName, input, response)
+	default:
+		isError = streamToolCallComplete(w, flusher, block.ID, block.Name, json.RawMessage(block.JSON.Input.Raw()), response)
+	}
+
+	outcome := toolOutcomeSuccess
+	if isError {
+		outcome = toolOutcomeError
+	}
+	toolCallsTotal.Inc(toolName, outcome)
+	toolCallDuration.ObserveDuration(time.Since(start), toolName)
+	span.SetAttributes(
+		tracing.String("rishi.tool.command", toolName),
+		tracing.String("rishi.tool.outcome", outcome),
+		tracing.Int("rishi.tool.result_bytes", len(b)),
+	)
+	if isError {
+		span.SetStatus(tracing.StatusError, "tool returned an error")
+	}
+
+	return string(b), isError, nil
+}
@@ -0,0 +1,522 @@
+package api
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/halliday/rishi/daemon/internal/errcode"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	usageFileName  = "usage.jsonl"
+	usageDayLayout = "2006-01-02"
+
+	// maxUsageSessions bounds how many sessions' totals the usage store keeps in memory.
+	// Evicted totals are read back from the usage file when they're next needed.
+	maxUsageSessions = 1000
+)
+
+// modelPricing holds USD prices per million tokens for a model family
+type modelPricing struct {
+	Input      float64
+	Output     float64
+	CacheWrite float64
+	CacheRead  float64
+}
+
+// modelPrices maps model name prefixes to their pricing. Prefixes are used so
+// that dated snapshots (e.g. claude-3-7-sonnet-20250219) match their family.
+var modelPrices = []struct {
+	Prefix  string
+	Pricing modelPricing
+}{
+	{"claude-sonnet-4", modelPricing{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.30}},
+	{"claude-4-sonnet", modelPricing{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.30}},
+	{"claude-3-7-sonnet", modelPricing{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.30}},
+	{"claude-3-5-sonnet", modelPricing{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.30}},
+	{"claude-opus-4", modelPricing{Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.50}},
+	{"claude-4-opus", modelPricing{Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.50}},
+	{"claude-3-5-haiku", modelPricing{Input: 0.80, Output: 4, CacheWrite: 1, CacheRead: 0.08}},
+}
+
+// lookupPricing returns the pricing for a model, or false if the model is unknown
+func lookupPricing(model string) (modelPricing, bool) {
+	for _, p := range modelPrices {
+		if strings.HasPrefix(model, p.Prefix) {
+			return p.Pricing, true
+		}
+	}
+	return modelPricing{}, false
+}
+
+// usageRecord is a single model turn's token usage, persisted as one line of usage.jsonl
+type usageRecord struct {
+	Time                     time.Time `json:"time"`
+	SessionID                string    `json:"session_id,omitempty"`
+	RunID                    string    `json:"run_id"`
+	Model                    string    `json:"model"`
+	InputTokens              int64     `json:"input_tokens"`
+	OutputTokens             int64     `json:"output_tokens"`
+	CacheCreationInputTokens int64     `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64     `json:"cache_read_input_tokens"`
+	CostUSD                  float64   `json:"cost_usd"`
+	// Partial is set for model turns that failed after the model started responding
+	Partial bool `json:"partial,omitempty"`
+}
+
+// newUsageRecord builds a usage record from the usage reported on an accumulated message
+func newUsageRecord(sessionID, runID, model string, usage anthropic.Usage) usageRecord {
+	rec := usageRecord{
+		Time:                     time.Now().UTC(),
+		SessionID:                sessionID,
+		RunID:                    runID,
+		Model:                    model,
+		InputTokens:              usage.InputTokens,
+		OutputTokens:             usage.OutputTokens,
+		CacheCreationInputTokens: usage.CacheCreationInputTokens,
+		CacheReadInputTokens:     usage.CacheReadInputTokens,
+	}
+
+	if pricing, ok := lookupPricing(model); ok {
+		rec.CostUSD = (float64(rec.InputTokens)*pricing.Input +
+			float64(rec.OutputTokens)*pricing.Output +
+			float64(rec.CacheCreationInputTokens)*pricing.CacheWrite +
+			float64(rec.CacheReadInputTokens)*pricing.CacheRead) / 1_000_000
+	} else {
+		log.Warn().Str("model", model).Msg("No pricing known for model, cost recorded as 0")
+	}
+
+	return rec
+}
+
+// usageTotals aggregates usage across one or more model turns
+type usageTotals struct {
+	Turns                    int     `json:"turns"`
+	InputTokens              int64   `json:"input_tokens"`
+	OutputTokens             int64   `json:"output_tokens"`
+	CacheCreationInputTokens int64   `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64   `json:"cache_read_input_tokens"`
+	CacheHitRate             float64 `json:"cache_hit_rate"`
+	CostUSD                  float64 `json:"cost_usd"`
+}
+
+func (t *usageTotals) add(rec usageRecord) {
+	t.Turns++
+	t.InputTokens += rec.InputTokens
+	t.OutputTokens += rec.OutputTokens
+	t.CacheCreationInputTokens += rec.CacheCreationInputTokens
+	t.CacheReadInputTokens += rec.CacheReadInputTokens
+	t.CostUSD += rec.CostUSD
+	t.CacheHitRate = cacheHitRate(t.InputTokens, t.CacheCreationInputTokens, t.CacheReadInputTokens)
+}
+
+// usageGroup is one bucket of a usage report
+type usageGroup struct {
+	Key string `json:"key"`
+	usageTotals
+}
+
+// usageStore appends usage records to usage.jsonl in the config directory, so spend
+// survives daemon restarts, and reads the file back for reports. Only the totals of
+// recently active sessions are kept in memory.
+//
+// Reads don't take s.mu, so reports never hold up the model turns recording usage. Each
+// record is appended as one line, and a line still being written doesn't parse yet.
+type usageStore struct {
+	mu   sync.Mutex
+	path string
+	// sessions holds the running totals of recently active chat sessions, most recently
+	// used first, and sessionIndex finds them by ID
+	sessions     *list.List
+	sessionIndex map[string]*list.Element
+	// records keeps the usage in memory when the config directory is unavailable
+	records []usageRecord
+}
+
+// sessionUsage is a chat session's running totals in the usage store's cache
+type sessionUsage struct {
+	id     string
+	totals usageTotals
+}
+
+// newUsageStore returns the store for the config directory's usage file. If the config
+// directory is unavailable the store still works, but only keeps records in memory.
+func newUsageStore() *usageStore {
+	store := &usageStore{sessions: list.New(), sessionIndex: map[string]*list.Element{}}
+
+	configDir, err := getConfigDir()
+	if err != nil {
+		log.Warn().Err(err).Msg("Usage will not be persisted")
+		return store
+	}
+	store.path = filepath.Join(configDir, usageFileName)
+	return store
+}
+
+// readUsageFile calls fn with each complete usage record in the file at path from offset
+// on, skipping malformed lines, and returns the offset after the last complete line
+func readUsageFile(path string, offset int64, fn func(rec usageRecord)) (int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return offset, nil
+	}
+	if err != nil {
+		return offset, fmt.Errorf("failed to open usage file: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, fmt.Errorf("failed to read usage file: %w", err)
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line is still being appended
+			return offset, nil
+		}
+		if err != nil {
+			return offset, fmt.Errorf("failed to read usage file: %w", err)
+		}
+		offset += int64(len(line))
+
+		var rec usageRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			continue
+		}
+		fn(rec)
+	}
+}
+
+// each calls fn with every usage record in the order they were recorded, skipping
+// malformed lines
+func (s *usageStore) each(fn func(rec usageRecord)) error {
+	if s.path == "" {
+		s.mu.Lock()
+		records := slices.Clone(s.records)
+		s.mu.Unlock()
+		for _, rec := range records {
+			fn(rec)
+		}
+		return nil
+	}
+
+	_, err := readUsageFile(s.path, 0, fn)
+	return err
+}
+
+// scan is each for callers that report a partial history rather than fail
+func (s *usageStore) scan(fn func(rec usageRecord)) {
+	if err := s.each(fn); err != nil {
+		log.Warn().Err(err).Str("path", s.path).Msg("Failed to read usage history")
+	}
+}
+
+// cachedSession returns a session's cached totals and marks them recently used. The caller
+// must hold s.mu.
+func (s *usageStore) cachedSession(sessionID string) (*usageTotals, bool) {
+	elem, ok := s.sessionIndex[sessionID]
+	if !ok {
+		return nil, false
+	}
+	s.sessions.MoveToFront(elem)
+	return &elem.Value.(*sessionUsage).totals, true
+}
+
+// cacheSession caches a session's totals, evicting the least recently used session once
+// maxUsageSessions are cached. The caller must hold s.mu.
+func (s *usageStore) cacheSession(sessionID string, totals usageTotals) {
+	s.sessionIndex[sessionID] = s.sessions.PushFront(&sessionUsage{id: sessionID, totals: totals})
+	if s.sessions.Len() > maxUsageSessions {
+		oldest := s.sessions.Remove(s.sessions.Back()).(*sessionUsage)
+		delete(s.sessionIndex, oldest.id)
+	}
+}
+
+// Record stores a usage record and appends it to the usage file
+func (s *usageStore) Record(rec usageRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A session that isn't cached picks the record up from the file when it's loaded
+	if totals, ok := s.cachedSession(rec.SessionID); ok {
+		totals.add(rec)
+	}
+
+	if s.path == "" {
+		s.records = append(s.records, rec)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		log.Warn().Err(err).Msg("Failed to create config directory for usage file")
+		return
+	}
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to open usage file")
+		return
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to marshal usage record")
+		return
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		log.Warn().Err(err).Msg("Failed to write usage record")
+	}
+}
+
+// SessionTotals returns the aggregated usage for a session. A session's history is read
+// from the usage file the first time without holding s.mu, then brought up to date with
+// the records appended meanwhile.
+func (s *usageStore) SessionTotals(sessionID string) usageTotals {
+	s.mu.Lock()
+	if totals, ok := s.cachedSession(sessionID); ok {
+		defer s.mu.Unlock()
+		return *totals
+	}
+	if s.path == "" {
+		defer s.mu.Unlock()
+		var totals usageTotals
+		for _, rec := range s.records {
+			if rec.SessionID == sessionID {
+				totals.add(rec)
+			}
+		}
+		s.cacheSession(sessionID, totals)
+		return totals
+	}
+	s.mu.Unlock()
+
+	var totals usageTotals
+	addSession := func(rec usageRecord) {
+		if rec.SessionID == sessionID {
+			totals.add(rec)
+		}
+	}
+	offset, err := readUsageFile(s.path, 0, addSession)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cached, ok := s.cachedSession(sessionID); ok {
+		// Loaded by a concurrent call
+		return *cached
+	}
+	if err == nil {
+		// Records are only appended under s.mu, so the rest of the file is complete
+		_, err = readUsageFile(s.path, offset, addSession)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("path", s.path).Msg("Failed to read usage history")
+		return totals
+	}
+	s.cacheSession(sessionID, totals)
+	return totals
+}
+
+// Query aggregates usage records in [from, to) grouped by model, session or day
+func (s *usageStore) Query(from, to time.Time, groupBy string) ([]usageGroup, usageTotals) {
+	var total usageTotals
+	groups := map[string]*usageGroup{}
+	s.scan(func(rec usageRecord) {
+		if rec.Time.Before(from) || !rec.Time.Before(to) {
+			return
+		}
+
+		var key string
+		switch groupBy {
+		case "model":
+			key = rec.Model
+		case "session":
+			key = rec.SessionID
+		default:
+			key = rec.Time.Format(usageDayLayout)
+		}
+
+		group, ok := groups[key]
+		if !ok {
+			group = &usageGroup{Key: key}
+			groups[key] = group
+		}
+		group.add(rec)
+		total.add(rec)
+	})
+
+	result := make([]usageGroup, 0, len(groups))
+	for _, group := range groups {
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+
+	return result, total
+}
+
+// parseUsageTime accepts either an RFC 3339 timestamp or a YYYY-MM-DD date
+func parseUsageTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(usageDayLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: expected RFC 3339 or YYYY-MM-DD", value)
+	}
+	return t, nil
+}
+
+// usageReport aggregates usage records with s.Query, given its from, to (RFC 3339 or
+// YYYY-MM-DD; a date "to" is inclusive) and group_by (model | session | day, default day)
+// parameters as strings
+func (s *usageStore) usageReport(fromParam, toParam, groupBy string) (map[string]any, *errcode.Error) {
+	from := time.Time{}
+	if fromParam != "" {
+		t, err := parseUsageTime(fromParam)
+		if err != nil {
+			return nil, errcode.New(errcode.InvalidRequest, err.Error()).WithDetail("parameter", "from")
+		}
+		from = t
+	}
+
+	to := time.Now().UTC().Add(time.Second)
+	if toParam != "" {
+		t, err := parseUsageTime(toParam)
+		if err != nil {
+			return nil, errcode.New(errcode.InvalidRequest, err.Error()).WithDetail("parameter", "to")
+		}
+		// A bare date means "through the end of that day"
+		if len(toParam) == len(usageDayLayout) {
+			t = t.AddDate(0, 0, 1)
+		}
+		to = t
+	}
+
+	switch groupBy {
+	case "":
+		groupBy = "day"
+	case "model", "session", "day":
+	default:
+		return nil, errcode.New(errcode.InvalidRequest, "group_by must be one of model, session, day").WithDetail("parameter", "group_by")
+	}
+
+	groups, total := s.Query(from, to, groupBy)
+	return map[string]any{
+		"group_by": groupBy,
+		"groups":   groups,
+		"total":    total,
+	}, nil
+}
+
+// handleGetUsage returns aggregated token usage and cost.
+// Query parameters: from, to (RFC 3339 or YYYY-MM-DD; a date "to" is inclusive)
+// and group_by (model | session | day, default day).
+func (s *ServerClient) handleGetUsage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	report, apiErr := s.usage.usageReport(query.Get("from"), query.Get("to"), query.Get("group_by"))
+	if apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// UsageReport aggregates the usage history like GET /usage, reading it from the config
+// directory so that it works without a running daemon
+func UsageReport(from, to, groupBy string) (map[string]any, error) {
+	report, apiErr := newUsageStore().usageReport(from, to, groupBy)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return report, nil
+}
+
+// ChatSession summarizes a chat session from its usage records, which are all the daemon
+// keeps of it; the conversation itself stays with the frontend
+type ChatSession struct {
+	ID        string    `json:"id"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Runs      int       `json:"runs"`
+	usageTotals
+}
+
+// Sessions summarizes every chat session, most recently active first
+func (s *usageStore) Sessions() []ChatSession {
+	sessions := map[string]*ChatSession{}
+	runs := map[string]map[string]bool{}
+	s.scan(func(rec usageRecord) {
+		if rec.SessionID == "" {
+			return
+		}
+		session, ok := sessions[rec.SessionID]
+		if !ok {
+			session = &ChatSession{ID: rec.SessionID, FirstSeen: rec.Time}
+			sessions[rec.SessionID] = session
+			runs[rec.SessionID] = map[string]bool{}
+		}
+		if rec.Time.Before(session.FirstSeen) {
+			session.FirstSeen = rec.Time
+		}
+		if rec.Time.After(session.LastSeen) {
+			session.LastSeen = rec.Time
+		}
+		runs[rec.SessionID][rec.RunID] = true
+		session.add(rec)
+	})
+
+	result := make([]ChatSession, 0, len(sessions))
+	for id, session := range sessions {
+		session.Runs = len(runs[id])
+		result = append(result, *session)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LastSeen.After(result[j].LastSeen) })
+	return result
+}
+
+// ListChatSessions summarizes the chat sessions in the usage history
+func ListChatSessions() []ChatSession {
+	return newUsageStore().Sessions()
+}
+
+// ExportChatSession writes a chat session's usage records to w as JSON lines
+func ExportChatSession(id string, w io.Writer) error {
+	store := newUsageStore()
+	enc := json.NewEncoder(w)
+	found := false
+	var encodeErr error
+	err := store.each(func(rec usageRecord) {
+		if rec.SessionID != id || encodeErr != nil {
+			return
+		}
+		found = true
+		encodeErr = enc.Encode(rec)
+	})
+	if err != nil {
+		return err
+	}
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if !found {
+		return fmt.Errorf("no chat session %s in the usage history", id)
+	}
+	return nil
+}
@@ -1,10 +1,13 @@
 package api
 
 import (
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/invopop/jsonschema"
@@ -25,10 +28,25 @@ func GenerateSchema[T any]() anthropic.ToolInputSchemaParam {
 	}
 }
 
+// streamToolInputDelta writes a fragment of a tool's input JSON as the model generates it, so the
+// frontend can show large inputs (e.g. a whole file passed to create) while they are being written.
+// Concatenating every partial_json for a tool use ID yields the complete input.
+func streamToolInputDelta(w http.ResponseWriter, flusher http.Flusher, toolUseID string, name string, partialJSON string) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"tool_input_delta": map[string]any{
+			"tool_use_id":  toolUseID,
+			"name":         name,
+			"partial_json": partialJSON,
+		},
+	})
+	flusher.Flush()
+}
+
 // streamToolCallStart writes a tool call start event to the response stream so we can see the tool call in the frontend
-func streamToolCallStart(w http.ResponseWriter, flusher http.Flusher, name string, input interface{}) {
+func streamToolCallStart(w http.ResponseWriter, flusher http.Flusher, toolUseID string, name string, input interface{}) {
 	_ = json.NewEncoder(w).Encode(map[string]any{
 		"tool_call": map[string]any{
+			"id":     toolUseID,
 			"name":   name,
 			"input":  input,
 			"status": "requesting",
@@ -38,9 +56,10 @@ func streamToolCallStart(w http.ResponseWriter, flusher http.Flusher, name strin
 }
 
 // streamToolCallComplete writes a tool call completion event to the response stream so we can see the tool call in the frontend
-func streamToolCallComplete(w http.ResponseWriter, flusher http.Flusher, name string, input interface{}, result interface{}) bool {
+func streamToolCallComplete(w http.ResponseWriter, flusher http.Flusher, toolUseID string, name string, input interface{}, result interface{}) bool {
 	_ = json.NewEncoder(w).Encode(map[string]any{
 		"tool_call": map[string]any{
+			"id":     toolUseID,
 			"name":   name,
 			"input":  input,
 			"status": "completed",
@@ -59,10 +78,63 @@ func streamToolCallComplete(w http.ResponseWriter, flusher http.Flusher, name st
 		return r.Error != ""
 	case textEditorInsertOutput:
 		return r.Error != ""
+	case toolErrorOutput:
+		return true
 	}
 	return false
 }
 
+// streamUsage writes a usage event after each model turn with the turn's usage and running totals
+func streamUsage(w http.ResponseWriter, flusher http.Flusher, turn usageRecord, run usageTotals, session *usageTotals) {
+	usage := map[string]any{
+		"model":                       turn.Model,
+		"input_tokens":                turn.InputTokens,
+		"output_tokens":               turn.OutputTokens,
+		"cache_creation_input_tokens": turn.CacheCreationInputTokens,
+		"cache_read_input_tokens":     turn.CacheReadInputTokens,
+		"cache_hit_rate":              cacheHitRate(turn.InputTokens, turn.CacheCreationInputTokens, turn.CacheReadInputTokens),
+		"cost_usd":                    turn.CostUSD,
+		"run":                         run,
+	}
+	if session != nil {
+		usage["session"] = session
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"usage": usage})
+	flusher.Flush()
+}
+
+// streamInstructions writes an event listing the instruction files applied to the system prompt
+func streamInstructions(w http.ResponseWriter, flusher http.Flusher, files []instructionFile) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"instructions": map[string]any{
+			"files": files,
+		},
+	})
+	flusher.Flush()
+}
+
+// streamRetrying writes an event announcing that a failed model turn will be retried after wait.
+// discardPartial tells the frontend that output already streamed for the turn will be resent.
+func streamRetrying(w http.ResponseWriter, flusher http.Flusher, attempt int, wait time.Duration, perr *providerError, discardPartial bool) {
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"retrying": map[string]any{
+			"attempt":         attempt,
+			"max_attempts":    maxModelRetries,
+			"wait_ms":         wait.Milliseconds(),
+			"error":           perr.apiError(),
+			"discard_partial": discardPartial,
+		},
+	})
+	flusher.Flush()
+}
+
+// newID returns a random 16-byte hex identifier
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // inboundContent defines content types for inbound messages
 type inboundContent struct {
 	Type       string `json:"type"`                 // "text" | "image"
@@ -71,8 +143,6 @@ type inboundContent struct {
 	DataBase64 string `json:"dataBase64,omitempty"` // for image content
 }
 
-const maxImageSize = 5 * 1024 * 1024 // 5MB per image
-
 // validateImageContent validates image content blocks
 func validateImageContent(content inboundContent) error {
 	// Validate media type
@@ -94,7 +164,7 @@ func validateImageContent(content inboundContent) error {
 	}
 
 	// Validate size
-	if len(data) > maxImageSize {
+	if maxImageSize := currentSettings().MaxImageSize; len(data) > maxImageSize {
 		return fmt.Errorf("image too large: %d bytes (max %d bytes)", len(data), maxImageSize)
 	}
 
@@ -118,7 +188,7 @@ func convertToAnthropicContent(contents []inboundContent) ([]anthropic.ContentBl
 
 			blocks = append(blocks, anthropic.NewImageBlockBase64(content.MediaType, content.DataBase64))
 		default:
-			log.Warn().Msgf("Unknown content type: %s", content.Type)
+			log.Warn().Str("type", content.Type).Msg("Unknown content type")
 		}
 	}
 
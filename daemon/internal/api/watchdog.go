@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// activityTracker records when the daemon last received a request
+type activityTracker struct {
+	last atomic.Int64
+}
+
+func newActivityTracker() *activityTracker {
+	t := &activityTracker{}
+	t.touch()
+	return t
+}
+
+func (t *activityTracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *activityTracker) since() time.Duration {
+	return time.Since(time.Unix(0, t.last.Load()))
+}
+
+// passiveRoutes are polled by the UI and monitoring on their own, so they don't count as
+// activity for the idle timeout
+var passiveRoutes = map[string]bool{
+	"/health":    true,
+	"/ready":     true,
+	"/metrics":   true,
+	"/safe_root": true,
+}
+
+// TrackActivity returns a middleware that records each request for the idle timeout, when
+// it starts and again when it ends, so the idle period starts after a long chat run
+// finishes. Health, metrics and safe root polls aren't counted, and neither are R session
+// registrations, which count only when they add a session.
+func (s *ServerClient) TrackActivity() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if passiveRoutes[r.URL.Path] || (r.Method == http.MethodPost && r.URL.Path == "/r-sessions") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			s.activity.touch()
+			defer s.activity.touch()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RunWatchdog checks every interval, until ctx is done, whether the daemon should exit on
+// its own, and calls stop with the reason once it should: when the process that launched
+// it has exited and no R session is left, or when it has had no requests and no active
+// runs for the idle timeout. R sessions whose process has exited are dropped on each
+// check. A parentPID of 0 disables the parent check.
+func (s *ServerClient) RunWatchdog(ctx context.Context, parentPID int, interval time.Duration, stop func(reason string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		remaining := s.removeExitedRSessions()
+		if parentPID != 0 && !processAlive(parentPID) && remaining == 0 {
+			stop("parent process exited")
+			return
+		}
+		idleTimeout := time.Duration(currentSettings().IdleTimeout)
+		if idleTimeout > 0 && s.runs.count() == 0 && s.activity.since() >= idleTimeout {
+			stop("idle timeout")
+			return
+		}
+	}
+}
+
+// removeExitedRSessions drops the R sessions whose process has exited and returns how many
+// are left. Sessions registered without a PID are left to the health checks.
+func (s *ServerClient) removeExitedRSessions() int {
+	sessions := s.rSessions.List()
+	remaining := len(sessions)
+	for _, session := range sessions {
+		if session.PID != 0 && !processAlive(session.PID) && s.rSessions.Remove(session.ID) {
+			log.Info().Str("r_session_id", session.ID).Int("pid", session.PID).Msg("Removed R session whose process exited")
+			remaining--
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,155 @@
+// Package credentials stores provider secrets such as API keys.
+//
+// A Store holds any number of named credentials per provider, addressed by a Ref written
+// "provider/name" (for example "anthropic/default"). Two backends are provided: FileStore
+// keeps credentials in an AES-GCM encrypted file, and EnvStore reads them from environment
+// variables. Chain layers several stores so that, for example, environment variables
+// override the encrypted file.
+package credentials
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultName is the name of a provider's credential when none is given
+const DefaultName = "default"
+
+var (
+	// ErrNotFound is returned when a credential doesn't exist
+	ErrNotFound = errors.New("credential not found")
+	// ErrReadOnly is returned when writing to a store that can't be modified
+	ErrReadOnly = errors.New("credential store is read-only")
+)
+
+// Credential is a named secret for a provider
+type Credential struct {
+	Provider    string     `json:"provider"`
+	Name        string     `json:"name"`
+	Secret      string     `json:"secret"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	ValidatedAt *time.Time `json:"validated_at,omitempty"`
+	// Source names the backend the credential was read from, e.g. "file" or "env"
+	Source string `json:"-"`
+}
+
+// Ref returns the credential's reference
+func (c Credential) Ref() Ref {
+	return Ref{Provider: c.Provider, Name: c.Name}
+}
+
+// Ref identifies a credential
+type Ref struct {
+	Provider string
+	Name     string
+}
+
+var refPartPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_\-]*$`)
+
+// ParseRef parses "provider/name", or "provider" for the provider's default credential
+func ParseRef(s string) (Ref, error) {
+	provider, name, found := strings.Cut(strings.ToLower(strings.TrimSpace(s)), "/")
+	if !found {
+		name = DefaultName
+	}
+	ref := Ref{Provider: provider, Name: name}
+	return ref, ref.Validate()
+}
+
+// Validate checks that the provider and name are non-empty lowercase identifiers
+func (r Ref) Validate() error {
+	if !refPartPattern.MatchString(r.Provider) {
+		return fmt.Errorf("invalid credential provider %q", r.Provider)
+	}
+	if !refPartPattern.MatchString(r.Name) {
+		return fmt.Errorf("invalid credential name %q", r.Name)
+	}
+	return nil
+}
+
+func (r Ref) String() string {
+	return r.Provider + "/" + r.Name
+}
+
+// Store reads and writes credentials
+type Store interface {
+	// Get returns the credential for ref, or ErrNotFound
+	Get(ref Ref) (Credential, error)
+	// List returns the provider's credentials, or every credential if provider is empty
+	List(provider string) ([]Credential, error)
+	// Set creates or replaces a credential
+	Set(cred Credential) error
+	// Delete removes a credential, returning ErrNotFound if it doesn't exist
+	Delete(ref Ref) error
+}
+
+// Chain is a Store that reads from each store in order, so earlier stores take precedence,
+// and writes to the first store that isn't read-only.
+type Chain []Store
+
+// Get returns the credential from the first store that has it
+func (c Chain) Get(ref Ref) (Credential, error) {
+	for _, store := range c {
+		cred, err := store.Get(ref)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		return cred, err
+	}
+	return Credential{}, ErrNotFound
+}
+
+// List merges the stores' credentials, keeping the first of any with the same ref
+func (c Chain) List(provider string) ([]Credential, error) {
+	seen := map[Ref]bool{}
+	var creds []Credential
+	for _, store := range c {
+		list, err := store.List(provider)
+		if err != nil {
+			return nil, err
+		}
+		for _, cred := range list {
+			if !seen[cred.Ref()] {
+				seen[cred.Ref()] = true
+				creds = append(creds, cred)
+			}
+		}
+	}
+	sortCredentials(creds)
+	return creds, nil
+}
+
+// Set writes to the first writable store
+func (c Chain) Set(cred Credential) error {
+	for _, store := range c {
+		err := store.Set(cred)
+		if errors.Is(err, ErrReadOnly) {
+			continue
+		}
+		return err
+	}
+	return ErrReadOnly
+}
+
+// Delete removes the credential from the first writable store
+func (c Chain) Delete(ref Ref) error {
+	for _, store := range c {
+		err := store.Delete(ref)
+		if errors.Is(err, ErrReadOnly) {
+			continue
+		}
+		return err
+	}
+	return ErrReadOnly
+}
+
+func sortCredentials(creds []Credential) {
+	slices.SortFunc(creds, func(a, b Credential) int {
+		return strings.Compare(a.Ref().String(), b.Ref().String())
+	})
+}
@@ -0,0 +1,91 @@
+package credentials
+
+import (
+	"os"
+	"strings"
+)
+
+// envPrefix marks environment variables holding named credentials:
+// RISHI_CREDENTIAL_<PROVIDER>_<NAME>=secret, e.g. RISHI_CREDENTIAL_ANTHROPIC_WORK
+const envPrefix = "RISHI_CREDENTIAL_"
+
+// providerEnvVars are the conventional variables holding a provider's default credential
+var providerEnvVars = map[string]string{
+	"ANTHROPIC_API_KEY": "anthropic",
+}
+
+// EnvStore is a read-only Store backed by environment variables. A provider's conventional
+// variable such as ANTHROPIC_API_KEY provides its default credential, and
+// RISHI_CREDENTIAL_<PROVIDER>_<NAME> provides named ones.
+type EnvStore struct {
+	environ func() []string
+}
+
+// NewEnvStore creates a store reading the process environment
+func NewEnvStore() *EnvStore {
+	return &EnvStore{environ: os.Environ}
+}
+
+func (s *EnvStore) load() map[Ref]Credential {
+	creds := map[Ref]Credential{}
+	for _, entry := range s.environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		if value == "" {
+			continue
+		}
+
+		var ref Ref
+		if provider, ok := providerEnvVars[key]; ok {
+			ref = Ref{Provider: provider, Name: DefaultName}
+		} else if rest, ok := strings.CutPrefix(key, envPrefix); ok {
+			provider, name, found := strings.Cut(strings.ToLower(rest), "_")
+			if !found {
+				name = DefaultName
+			}
+			ref = Ref{Provider: provider, Name: strings.ReplaceAll(name, "_", "-")}
+		} else {
+			continue
+		}
+		if ref.Validate() != nil {
+			continue
+		}
+
+		// Named variables win over the conventional one for the same ref
+		if _, exists := creds[ref]; exists && providerEnvVars[key] != "" {
+			continue
+		}
+		creds[ref] = Credential{Provider: ref.Provider, Name: ref.Name, Secret: value, Source: "env"}
+	}
+	return creds
+}
+
+// Get returns the credential for ref from the environment
+func (s *EnvStore) Get(ref Ref) (Credential, error) {
+	cred, ok := s.load()[ref]
+	if !ok {
+		return Credential{}, ErrNotFound
+	}
+	return cred, nil
+}
+
+// List returns the environment's credentials for provider, or all of them if provider is empty
+func (s *EnvStore) List(provider string) ([]Credential, error) {
+	var creds []Credential
+	for _, cred := range s.load() {
+		if provider == "" || cred.Provider == provider {
+			creds = append(creds, cred)
+		}
+	}
+	sortCredentials(creds)
+	return creds, nil
+}
+
+// Set always fails; environment credentials can't be changed at runtime
+func (s *EnvStore) Set(Credential) error {
+	return ErrReadOnly
+}
+
+// Delete always fails; environment credentials can't be changed at runtime
+func (s *EnvStore) Delete(Ref) error {
+	return ErrReadOnly
+}
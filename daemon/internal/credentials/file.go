@@ -0,0 +1,356 @@
+package credentials
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// fileFormatVersion is the version of the encrypted file envelope
+	fileFormatVersion = 1
+
+	// Key derivation modes recorded in the envelope
+	kdfScrypt  = "scrypt"
+	kdfKeyFile = "keyfile"
+
+	// scrypt parameters recommended for interactive logins
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+
+	keySize  = 32
+	saltSize = 16
+)
+
+// fileEnvelope is the on-disk form of an encrypted credentials file
+type fileEnvelope struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// filePayload is the decrypted content of a credentials file
+type filePayload struct {
+	Credentials []Credential `json:"credentials"`
+}
+
+// FileStore keeps credentials in a file encrypted with AES-256-GCM. The encryption key is
+// derived from a passphrase with scrypt when one is given, and is otherwise a random key
+// kept in a separate machine-local key file, readable only by the current user.
+type FileStore struct {
+	mu         sync.Mutex
+	path       string
+	keyPath    string
+	passphrase string
+	lock       func(fn func() error) error
+
+	// derivedKey is the key scrypt derived from the passphrase with derivedSalt. scrypt is
+	// slow by design, so the key is derived once and the salt reused for later writes.
+	derivedKey  []byte
+	derivedSalt []byte
+}
+
+// NewFileStore creates a store for the encrypted file at path. If passphrase is empty, the
+// key is read from keyPath, which is created on first write. Each change to the file is made
+// while holding lock, which should exclude other processes sharing the file; nil locks only
+// within this store.
+func NewFileStore(path, keyPath, passphrase string, lock func(fn func() error) error) *FileStore {
+	if lock == nil {
+		lock = func(fn func() error) error { return fn() }
+	}
+	return &FileStore{path: path, keyPath: keyPath, passphrase: passphrase, lock: lock}
+}
+
+// Get returns the credential for ref
+func (s *FileStore) Get(ref Ref) (Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payload, err := s.load()
+	if err != nil {
+		return Credential{}, err
+	}
+	for _, cred := range payload.Credentials {
+		if cred.Ref() == ref {
+			return cred, nil
+		}
+	}
+	return Credential{}, ErrNotFound
+}
+
+// List returns the stored credentials for provider, or all of them if provider is empty
+func (s *FileStore) List(provider string) ([]Credential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payload, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var creds []Credential
+	for _, cred := range payload.Credentials {
+		if provider == "" || cred.Provider == provider {
+			creds = append(creds, cred)
+		}
+	}
+	sortCredentials(creds)
+	return creds, nil
+}
+
+// Set creates or replaces a credential, keeping the original creation time
+func (s *FileStore) Set(cred Credential) error {
+	if err := cred.Ref().Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lock(func() error {
+		payload, err := s.load()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		cred.UpdatedAt = now
+		cred.Source = ""
+		replaced := false
+		for i, existing := range payload.Credentials {
+			if existing.Ref() == cred.Ref() {
+				cred.CreatedAt = existing.CreatedAt
+				payload.Credentials[i] = cred
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			cred.CreatedAt = now
+			payload.Credentials = append(payload.Credentials, cred)
+		}
+
+		return s.save(payload)
+	})
+}
+
+// Delete removes a credential
+func (s *FileStore) Delete(ref Ref) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lock(func() error {
+		payload, err := s.load()
+		if err != nil {
+			return err
+		}
+		for i, cred := range payload.Credentials {
+			if cred.Ref() == ref {
+				payload.Credentials = append(payload.Credentials[:i], payload.Credentials[i+1:]...)
+				return s.save(payload)
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// load decrypts the credentials file; a missing file holds no credentials
+func (s *FileStore) load() (*filePayload, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &filePayload{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+
+	var envelope fileEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %w", err)
+	}
+	if envelope.Version != fileFormatVersion {
+		return nil, fmt.Errorf("unsupported credentials file version %d", envelope.Version)
+	}
+
+	key, err := s.key(envelope.KDF, envelope.Salt, false)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decrypt(key, envelope.Nonce, envelope.Ciphertext)
+	if err != nil {
+		if envelope.KDF == kdfScrypt {
+			return nil, fmt.Errorf("failed to decrypt credentials file, check the passphrase: %w", err)
+		}
+		return nil, fmt.Errorf("failed to decrypt credentials file: %w", err)
+	}
+
+	var payload filePayload
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse decrypted credentials: %w", err)
+	}
+	for i := range payload.Credentials {
+		payload.Credentials[i].Source = "file"
+	}
+	return &payload, nil
+}
+
+// save encrypts payload and atomically replaces the credentials file. It encrypts with the
+// passphrase if one is configured, so a file created with a key file is upgraded on write.
+func (s *FileStore) save(payload *filePayload) error {
+	plaintext, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal credentials: %w", err)
+	}
+
+	envelope := fileEnvelope{Version: fileFormatVersion, KDF: kdfKeyFile}
+	if s.passphrase != "" {
+		envelope.KDF = kdfScrypt
+		envelope.Salt = s.derivedSalt
+		if envelope.Salt == nil {
+			envelope.Salt = make([]byte, saltSize)
+			if _, err := rand.Read(envelope.Salt); err != nil {
+				return fmt.Errorf("failed to generate salt: %w", err)
+			}
+		}
+	}
+
+	key, err := s.key(envelope.KDF, envelope.Salt, true)
+	if err != nil {
+		return err
+	}
+	envelope.Nonce, envelope.Ciphertext, err = encrypt(key, plaintext)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal credentials file: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// key returns the encryption key for the given derivation mode. With create set, a missing
+// key file is generated.
+func (s *FileStore) key(kdf string, salt []byte, create bool) ([]byte, error) {
+	switch kdf {
+	case kdfScrypt:
+		if s.passphrase == "" {
+			return nil, errors.New("credentials file is protected by a passphrase, but none is configured")
+		}
+		if s.derivedKey != nil && bytes.Equal(salt, s.derivedSalt) {
+			return s.derivedKey, nil
+		}
+		key, err := scrypt.Key([]byte(s.passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key: %w", err)
+		}
+		s.derivedKey, s.derivedSalt = key, salt
+		return key, nil
+	case kdfKeyFile:
+		return s.readKeyFile(create)
+	}
+	return nil, fmt.Errorf("unknown key derivation %q", kdf)
+}
+
+func (s *FileStore) readKeyFile(create bool) ([]byte, error) {
+	key, err := os.ReadFile(s.keyPath)
+	if err == nil {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("credentials key file %s is corrupt", s.keyPath)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) || !create {
+		return nil, fmt.Errorf("failed to read credentials key file: %w", err)
+	}
+
+	key = make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate credentials key: %w", err)
+	}
+	if err := writeFileAtomic(s.keyPath, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func encrypt(key, plaintext []byte) (nonce, ciphertext []byte, err error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func decrypt(key, nonce, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return gcm, nil
+}
+
+// writeFileAtomic writes data to a temp file readable only by the current user and
+// renames it over path
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write %s: %w", filepath.Base(path), err)
+	}
+	if err := tempFile.Chmod(0600); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to set permissions on %s: %w", filepath.Base(path), err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to move %s into place: %w", filepath.Base(path), err)
+	}
+	return nil
+}
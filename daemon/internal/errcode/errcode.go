@@ -0,0 +1,156 @@
+// Package errcode defines the error envelope and the stable error codes returned by the
+// Rishi daemon.
+//
+// Every failing HTTP endpoint responds with a JSON body of the form
+//
+//	{"error": {"code": "...", "message": "...", "retryable": false, "details": {...}, "request_id": "..."}}
+//
+// and the NDJSON chat stream reports failures as a line with the same shape. Tool results
+// that fail carry a code in their "error_code" field alongside the free-text "error".
+//
+// Codes are part of the daemon's API contract: clients switch on them, so existing codes
+// must never be renamed or reused for a different meaning. Messages are for humans and
+// may change at any time.
+package errcode
+
+import "net/http"
+
+// Code is a stable, machine-readable error identifier
+type Code string
+
+// Request errors: the client sent something the daemon can't act on.
+const (
+	// InvalidRequest means the request body or parameters were malformed.
+	InvalidRequest Code = "invalid_request"
+	// MethodNotAllowed means the endpoint doesn't support the HTTP method used.
+	MethodNotAllowed Code = "method_not_allowed"
+	// NotFound means the requested resource doesn't exist.
+	NotFound Code = "not_found"
+	// MissingAPIKey means no provider API key was supplied or configured.
+	MissingAPIKey Code = "missing_api_key"
+	// InvalidAPIKey means the supplied provider API key was rejected.
+	InvalidAPIKey Code = "invalid_api_key"
+	// Unauthorized means the request didn't carry the daemon's auth token.
+	Unauthorized Code = "unauthorized"
+	// ForbiddenOrigin means the request came from a browser origin the daemon doesn't serve.
+	ForbiddenOrigin Code = "forbidden_origin"
+	// Conflict means the request would have no effect because of how the daemon is set up.
+	Conflict Code = "conflict"
+)
+
+// Provider errors: the model provider (Anthropic) failed the request.
+const (
+	// ProviderOverloaded means the provider is temporarily overloaded.
+	ProviderOverloaded Code = "provider_overloaded"
+	// ProviderRateLimited means the API key hit the provider's rate limit.
+	ProviderRateLimited Code = "provider_rate_limited"
+	// ProviderServerError means the provider returned a 5xx error.
+	ProviderServerError Code = "provider_server_error"
+	// ProviderNetworkError means the provider couldn't be reached or the connection dropped.
+	ProviderNetworkError Code = "provider_network_error"
+	// ProviderAuthentication means the provider rejected the API key or its permissions.
+	ProviderAuthentication Code = "provider_authentication_error"
+	// ProviderInvalidRequest means the provider rejected the request as invalid.
+	ProviderInvalidRequest Code = "provider_invalid_request"
+	// ProviderError is any other provider failure.
+	ProviderError Code = "provider_error"
+)
+
+// Tool errors: a tool call requested by the model failed.
+const (
+	// ToolServerUnavailable means the R tool server couldn't be reached or returned an error.
+	ToolServerUnavailable Code = "tool_server_unavailable"
+	// ToolInvalidInput means the model sent input the tool couldn't parse or is missing fields.
+	ToolInvalidInput Code = "tool_invalid_input"
+	// ToolUnknown means the model called a tool the daemon doesn't provide.
+	ToolUnknown Code = "tool_unknown"
+)
+
+// Daemon errors.
+const (
+	// Canceled means the run was canceled, usually because the client disconnected.
+	Canceled Code = "canceled"
+	// ShuttingDown means the daemon is stopping and didn't start, or didn't finish, the run.
+	ShuttingDown Code = "shutting_down"
+	// NotReady means the daemon is running but can't serve chats yet, e.g. without an API key.
+	NotReady Code = "not_ready"
+	// StreamingUnsupported means the connection can't stream NDJSON responses.
+	StreamingUnsupported Code = "streaming_unsupported"
+	// ConfigError means the daemon's configuration couldn't be read or written.
+	ConfigError Code = "config_error"
+	// Internal means an unexpected daemon failure.
+	Internal Code = "internal_error"
+)
+
+// Retryable reports whether a request that failed with this code may succeed if sent again unchanged
+func (c Code) Retryable() bool {
+	switch c {
+	case ProviderOverloaded, ProviderRateLimited, ProviderServerError, ProviderNetworkError, ToolServerUnavailable, ShuttingDown, NotReady:
+		return true
+	}
+	return false
+}
+
+// HTTPStatus returns the status code used when an endpoint fails with this code
+func (c Code) HTTPStatus() int {
+	switch c {
+	case InvalidRequest, ProviderInvalidRequest, ToolInvalidInput, ToolUnknown:
+		return http.StatusBadRequest
+	case MissingAPIKey, InvalidAPIKey, ProviderAuthentication, Unauthorized:
+		return http.StatusUnauthorized
+	case ForbiddenOrigin:
+		return http.StatusForbidden
+	case NotFound:
+		return http.StatusNotFound
+	case MethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case Conflict:
+		return http.StatusConflict
+	case ProviderRateLimited:
+		return http.StatusTooManyRequests
+	case ProviderOverloaded, ToolServerUnavailable, ShuttingDown, NotReady:
+		return http.StatusServiceUnavailable
+	case ProviderServerError, ProviderNetworkError, ProviderError:
+		return http.StatusBadGateway
+	case Canceled:
+		// Non-standard but widely used "client closed request"
+		return 499
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is the error envelope body
+type Error struct {
+	Code      Code           `json:"code"`
+	Message   string         `json:"message"`
+	Retryable bool           `json:"retryable"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+}
+
+// New creates an error with the given code and human-readable message
+func New(code Code, message string) *Error {
+	return &Error{
+		Code:      code,
+		Message:   message,
+		Retryable: code.Retryable(),
+	}
+}
+
+func (e *Error) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// WithDetail adds a key to the error's details and returns the error
+func (e *Error) WithDetail(key string, value any) *Error {
+	if e.Details == nil {
+		e.Details = map[string]any{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+// Envelope wraps an Error as it appears on the wire
+type Envelope struct {
+	Error *Error `json:"error"`
+}
@@ -0,0 +1,145 @@
+// Package logging provides the daemon's log file output.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingFile is an io.Writer that appends to a log file and rotates it once it grows past
+// maxSize bytes. Rotated files are renamed path.1, path.2, ... up to maxBackups, oldest last.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	// rotateAt is the size past which the file is rotated; it's raised after a failed
+	// rotation so that the next attempt waits for another maxSize bytes
+	rotateAt int64
+	closed   bool
+}
+
+// NewRotatingFile opens (or creates) the log file at path, creating its directory if needed
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		rotateAt:   maxSize,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	f.file = file
+	f.size = stat.Size()
+	return nil
+}
+
+// Write appends p to the log file, rotating first if p would push it past the size limit.
+// If rotation fails, p is still appended to the current file and the error is returned
+// once.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		// Reopening after rotation failed
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(p)) > f.rotateAt {
+		if rotateErr = f.rotate(); rotateErr != nil {
+			if f.file == nil {
+				return 0, rotateErr
+			}
+			f.rotateAt = f.size + f.maxSize
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest backup, and starts a fresh file. If
+// the log file can't be moved aside, it's reopened to keep appending to it.
+func (f *RotatingFile) rotate() error {
+	// Windows can't rename an open file
+	f.file.Close()
+	f.file = nil
+
+	if err := f.shift(); err != nil {
+		if openErr := f.open(); openErr != nil {
+			return errors.Join(err, openErr)
+		}
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.rotateAt = f.maxSize
+	return nil
+}
+
+// shift moves the log file and its backups up by one, dropping the oldest backup
+func (f *RotatingFile) shift() error {
+	_ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate log file: %w", err)
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return fmt.Errorf("failed to remove log file: %w", err)
+	}
+	return nil
+}
+
+// Close closes the log file; further writes fail
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,226 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// instrumentationScope names the code that produced the spans
+const instrumentationScope = "github.com/halliday/rishi/daemon"
+
+// OTLP/JSON wire types, following opentelemetry-proto's ExportTraceServiceRequest.
+// IDs are hex strings and 64-bit integers are decimal strings, as the JSON mapping requires.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              SpanKind       `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    StatusCode `json:"code,omitempty"`
+		Message string     `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+// Resource describes the process producing spans
+type Resource struct {
+	ServiceName    string
+	ServiceVersion string
+}
+
+// encodeOTLP builds an ExportTraceServiceRequest for spans
+func encodeOTLP(resource Resource, spans []*Span) ([]byte, error) {
+	resourceAttrs := []otlpKeyValue{toKeyValue(String("service.name", resource.ServiceName))}
+	if resource.ServiceVersion != "" {
+		resourceAttrs = append(resourceAttrs, toKeyValue(String("service.version", resource.ServiceVersion)))
+	}
+
+	out := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		out = append(out, toOTLPSpan(span))
+	}
+
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: resourceAttrs},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: instrumentationScope, Version: resource.ServiceVersion},
+				Spans: out,
+			}},
+		}},
+	})
+}
+
+func toOTLPSpan(span *Span) otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(span.traceID[:]),
+		SpanID:            hex.EncodeToString(span.spanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: unixNano(span.start),
+		EndTimeUnixNano:   unixNano(span.end),
+		Status:            otlpStatus{Code: span.statusCode, Message: span.statusMessage},
+	}
+	if span.parentSpanID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(span.parentSpanID[:])
+	}
+	for _, attr := range span.attributes {
+		out.Attributes = append(out.Attributes, toKeyValue(attr))
+	}
+	return out
+}
+
+func toKeyValue(attr Attribute) otlpKeyValue {
+	kv := otlpKeyValue{Key: attr.Key}
+	switch v := attr.Value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// FileExporter appends each batch of spans to a writer as one line of OTLP/JSON, the
+// format read by the OpenTelemetry Collector's file receiver.
+type FileExporter struct {
+	mu       sync.Mutex
+	w        io.WriteCloser
+	resource Resource
+}
+
+// NewFileExporter creates an exporter writing to w, which it closes on Close
+func NewFileExporter(w io.WriteCloser, resource Resource) *FileExporter {
+	return &FileExporter{w: w, resource: resource}
+}
+
+// Export writes spans as a single line
+func (e *FileExporter) Export(_ context.Context, spans []*Span) error {
+	data, err := encodeOTLP(e.resource, spans)
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write spans: %w", err)
+	}
+	return nil
+}
+
+// Close closes the underlying writer
+func (e *FileExporter) Close() error {
+	return e.w.Close()
+}
+
+// HTTPExporter posts spans as OTLP/JSON to a collector's /v1/traces endpoint
+type HTTPExporter struct {
+	url      string
+	client   *http.Client
+	resource Resource
+}
+
+// NewHTTPExporter creates an exporter for the collector at endpoint. A bare endpoint such as
+// http://localhost:4318 gets /v1/traces appended, following OTEL_EXPORTER_OTLP_ENDPOINT.
+func NewHTTPExporter(endpoint string, resource Resource) *HTTPExporter {
+	url := strings.TrimRight(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &HTTPExporter{
+		url:      url,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		resource: resource,
+	}
+}
+
+// Export sends spans in one request
+func (e *HTTPExporter) Export(ctx context.Context, spans []*Span) error {
+	data, err := encodeOTLP(e.resource, spans)
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send spans: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close releases idle connections
+func (e *HTTPExporter) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
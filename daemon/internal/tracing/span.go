@@ -0,0 +1,192 @@
+// Package tracing records spans for agent runs and exports them in the OpenTelemetry
+// protocol's JSON encoding (OTLP/JSON), either to a local file or to an OTLP HTTP collector.
+//
+// Spans are created with Start and finished with End. Until a Tracer is installed with
+// SetTracer, Start returns a nil *Span, and every Span method is a no-op on nil, so
+// instrumented code never needs to check whether tracing is enabled.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// SpanKind describes the relationship between a span and its caller, as defined by OTLP
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// StatusCode is a span's final status, as defined by OTLP
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attribute is a key-value pair attached to a span
+type Attribute struct {
+	Key   string
+	Value any // string, int64, float64 or bool
+}
+
+// String returns a string attribute
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int returns an integer attribute
+func Int(key string, value int) Attribute {
+	return Attribute{Key: key, Value: int64(value)}
+}
+
+// Int64 returns an integer attribute
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Float64 returns a floating point attribute
+func Float64(key string, value float64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Bool returns a boolean attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	tracer *Tracer
+
+	mu            sync.Mutex
+	traceID       [16]byte
+	spanID        [8]byte
+	parentSpanID  [8]byte
+	name          string
+	kind          SpanKind
+	start         time.Time
+	end           time.Time
+	attributes    []Attribute
+	statusCode    StatusCode
+	statusMessage string
+	ended         bool
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span stored in ctx, or nil if there is none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start begins a span named name as a child of the span in ctx, or as the root of a new
+// trace if ctx has none. It returns a context carrying the new span. If no tracer is
+// installed, the span is nil and ctx is returned unchanged.
+func Start(ctx context.Context, name string, kind SpanKind, attrs ...Attribute) (context.Context, *Span) {
+	tracer := global.Load()
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     tracer,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: attrs,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.traceID = parent.traceID
+		span.parentSpanID = parent.spanID
+	} else {
+		_, _ = rand.Read(span.traceID[:])
+	}
+	_, _ = rand.Read(span.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// TraceID returns the span's trace ID in hex, or an empty string for a nil span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// TraceParent returns the span's W3C traceparent header value, or an empty string for a nil span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// SetAttributes adds attributes to the span, replacing any with the same key
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, attr := range attrs {
+		replaced := false
+		for i := range s.attributes {
+			if s.attributes[i].Key == attr.Key {
+				s.attributes[i] = attr
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.attributes = append(s.attributes, attr)
+		}
+	}
+}
+
+// SetStatus sets the span's final status
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCode = code
+	s.statusMessage = message
+}
+
+// RecordError marks the span as failed with err's message. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.SetStatus(StatusError, err.Error())
+}
+
+// End finishes the span and queues it for export. Calls after the first are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.enqueue(s)
+}
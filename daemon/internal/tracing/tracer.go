@@ -0,0 +1,167 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// batchSize is how many ended spans are buffered before an export is forced
+	batchSize = 128
+
+	// flushInterval is how often buffered spans are exported
+	flushInterval = 5 * time.Second
+
+	// queueSize caps spans waiting for export; further spans are dropped
+	queueSize = 4096
+)
+
+// Exporter sends finished spans to a backend
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+	Close() error
+}
+
+// Tracer batches finished spans and hands them to an exporter in the background
+type Tracer struct {
+	exporter Exporter
+	queue    chan *Span
+	flush    chan chan struct{}
+	done     chan struct{}
+	dropped  atomic.Int64
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+var global atomic.Pointer[Tracer]
+
+// SetTracer installs t as the tracer used by Start. Passing nil disables tracing.
+func SetTracer(t *Tracer) {
+	global.Store(t)
+}
+
+// NewTracer creates a tracer exporting to exporter and starts its export loop
+func NewTracer(exporter Exporter) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		queue:    make(chan *Span, queueSize),
+		flush:    make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		// Never block a run on tracing; count what we lose instead
+		t.dropped.Add(1)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), flushInterval)
+		defer cancel()
+		if err := t.exporter.Export(ctx, batch); err != nil {
+			log.Warn().Err(err).Int("spans", len(batch)).Msg("Failed to export trace spans")
+		}
+		if dropped := t.dropped.Swap(0); dropped > 0 {
+			log.Warn().Int64("spans", dropped).Msg("Dropped trace spans, export queue was full")
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case ack := <-t.flush:
+			// Drain anything already queued so Flush covers every span ended before it
+		drain:
+			for {
+				select {
+				case span, ok := <-t.queue:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, span)
+				default:
+					break drain
+				}
+			}
+			export()
+			close(ack)
+		}
+	}
+}
+
+// Flush exports every span ended so far, waiting until done or ctx expires
+func (t *Tracer) Flush(ctx context.Context) {
+	t.mu.RLock()
+	closed := t.closed
+	t.mu.RUnlock()
+	if closed {
+		return
+	}
+
+	ack := make(chan struct{})
+	select {
+	case t.flush <- ack:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-ack:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown stops accepting spans, exports what's buffered and closes the exporter
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+	}
+	return t.exporter.Close()
+}